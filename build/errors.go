@@ -0,0 +1,230 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/sosodev/heart/las"
+	"github.com/sosodev/heart/pool"
+)
+
+// how many lines of source to show on either side of the failing line in the dev error page
+const sourceContext = 5
+
+var (
+	devErrorTemplate = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Heart 💜 - Lua error</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+pre { background: #f6f2fa; padding: 1em; overflow-x: auto; }
+.failure { display: block; background: #e3c9f5; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Lua failed to handle the request</h1>
+<pre>{{.Message}}</pre>
+{{if .Lines}}<h2>{{.File}}</h2>
+<pre>{{range .Lines}}<span{{if .Failure}} class="failure"{{end}}>{{printf "%4d" .Number}}  {{.Text}}</span>
+{{end}}</pre>
+{{end}}<h2>Traceback</h2>
+<pre>{{.Traceback}}</pre>
+<p>This page is only shown when Heart isn't running in production.</p>
+</body>
+</html>
+`))
+)
+
+// sourceLine is a single line of Lua source shown in the dev error page
+type sourceLine struct {
+	Number  int
+	Text    string
+	Failure bool
+}
+
+// handle a Lua error raised while handling a request
+// the app's error handler gets the first shot at it and the built-in error responses are the fallback
+// the error handler runs under the same timeout as the route that failed and is just as strict about it
+func handleError(ctx *fiber.Ctx, luaErr error, timeout time.Duration, strict bool, statePool *pool.Pool) error {
+	trace := stackTrace(luaErr)
+
+	handled, err := dispatchError(ctx, luaErr, trace, timeout, strict, statePool)
+	if err == errTimedOut {
+		luaTimeouts.Inc()
+		log.Error().Str("timeout", timeout.String()).Msg("Lua error handler timed out")
+	} else if err != nil {
+		log.Error().Err(err).Msg("Lua failed to handle error")
+	}
+	if handled {
+		return nil
+	}
+
+	if appConfig.Production {
+		return fmt.Errorf("500 - Internal Server Error")
+	}
+
+	return devErrorPage(ctx, luaErr, trace)
+}
+
+// dispatch the error to the app's error handler if it registered one
+// the state that raised the error may be corrupted so the handler runs on a fresh one
+// returns true if the error handler took care of the response
+func dispatchError(ctx *fiber.Ctx, luaErr error, trace []lua.LuaStackEntry, timeout time.Duration, strict bool, statePool *pool.Pool) (bool, error) {
+	state, err := statePool.Take()
+	if err != nil {
+		return false, err
+	}
+	releaseState := false
+	defer func() {
+		if releaseState {
+			statePool.Discard(state)
+		} else {
+			statePool.Return(state)
+		}
+	}()
+
+	state.GetGlobal("_heart")
+	initialTop := state.GetTop()
+	defer state.Pop(1)
+
+	state.GetField(initialTop, "errorHandler")
+	hasHandler := state.IsFunction(-1)
+	state.Pop(1)
+	if !hasHandler {
+		return false, nil
+	}
+
+	err = las.Update(state, func(as *las.AssociatedState) error {
+		as.Ctx = ctx
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// whatever the failed handler got around to writing is thrown out
+	ctx.Response().ResetBody()
+	ctx.Status(fiber.StatusInternalServerError)
+
+	state.GetField(initialTop, "dispatchError")
+	state.GetField(initialTop, "ctx")
+	state.NewTable()
+	state.PushString(luaErr.Error())
+	state.SetField(-2, "message")
+	state.PushString(traceback(trace))
+	state.SetField(-2, "traceback")
+
+	if strict {
+		interpret(state)
+	}
+
+	hooked, err := callWithTimeout(state, 2, 3, timeout)
+	if hooked || err != nil {
+		releaseState = true
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, respond(ctx, state)
+}
+
+// render the built-in dev error page with the Lua stack and the source around the failure
+func devErrorPage(ctx *fiber.Ctx, luaErr error, trace []lua.LuaStackEntry) error {
+	file, lines := failureSource(trace)
+
+	page := new(bytes.Buffer)
+	err := devErrorTemplate.Execute(page, map[string]interface{}{
+		"Message":   luaErr.Error(),
+		"Traceback": traceback(trace),
+		"File":      file,
+		"Lines":     lines,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx.Response().ResetBody()
+	ctx.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return ctx.Status(fiber.StatusInternalServerError).Send(page.Bytes())
+}
+
+// get the Lua stack trace from the error if it has one
+func stackTrace(err error) []lua.LuaStackEntry {
+	luaErr, ok := err.(*lua.LuaError)
+	if !ok {
+		return nil
+	}
+
+	return luaErr.StackTrace()
+}
+
+// format the stack trace like Lua's own debug.traceback
+func traceback(trace []lua.LuaStackEntry) string {
+	var builder strings.Builder
+	builder.WriteString("stack traceback:")
+
+	for _, entry := range trace {
+		builder.WriteString("\n\t")
+		builder.WriteString(entry.ShortSource)
+		if entry.CurrentLine > 0 {
+			fmt.Fprintf(&builder, ":%d", entry.CurrentLine)
+		}
+
+		if entry.Name != "" {
+			fmt.Fprintf(&builder, ": in function '%s'", entry.Name)
+		} else {
+			builder.WriteString(": in ?")
+		}
+	}
+
+	return builder.String()
+}
+
+// find the innermost Lua file in the stack trace and read the lines around where it failed
+func failureSource(trace []lua.LuaStackEntry) (string, []sourceLine) {
+	for _, entry := range trace {
+		// sources starting with @ are files, anything else is a string chunk or a Go function
+		if !strings.HasPrefix(entry.Source, "@") || entry.CurrentLine <= 0 {
+			continue
+		}
+
+		path := strings.TrimPrefix(entry.Source, "@")
+		file, err := os.Open(path)
+		if err != nil {
+			return "", nil
+		}
+		defer file.Close()
+
+		lines := make([]sourceLine, 0, 2*sourceContext+1)
+		scanner := bufio.NewScanner(file)
+		for number := 1; scanner.Scan(); number++ {
+			if number < entry.CurrentLine-sourceContext {
+				continue
+			}
+			if number > entry.CurrentLine+sourceContext {
+				break
+			}
+
+			lines = append(lines, sourceLine{
+				Number:  number,
+				Text:    scanner.Text(),
+				Failure: number == entry.CurrentLine,
+			})
+		}
+
+		return path, lines
+	}
+
+	return "", nil
+}
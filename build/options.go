@@ -0,0 +1,53 @@
+package build
+
+import (
+	"github.com/aarzilli/golua/lua"
+)
+
+// read a boolean field from the options table at the given index
+// missing fields are false
+func optionBool(state *lua.State, index int, key string) bool {
+	state.GetField(index, key)
+	defer state.Pop(1)
+
+	return state.ToBoolean(-1)
+}
+
+// read an integer field from the options table at the given index
+// missing fields and fields that aren't numbers are 0
+func optionInt(state *lua.State, index int, key string) int {
+	state.GetField(index, key)
+	defer state.Pop(1)
+
+	if state.Type(-1) != lua.LUA_TNUMBER {
+		return 0
+	}
+
+	return state.ToInteger(-1)
+}
+
+// read a string field from the options table at the given index
+// missing fields and fields that aren't strings are empty
+func optionString(state *lua.State, index int, key string) string {
+	state.GetField(index, key)
+	defer state.Pop(1)
+
+	if state.Type(-1) != lua.LUA_TSTRING {
+		return ""
+	}
+
+	return state.ToString(-1)
+}
+
+// read a number field from the options table at the given index
+// the second return value is false for missing fields and fields that aren't numbers
+func optionNumber(state *lua.State, index int, key string) (float64, bool) {
+	state.GetField(index, key)
+	defer state.Pop(1)
+
+	if state.Type(-1) != lua.LUA_TNUMBER {
+		return 0, false
+	}
+
+	return state.ToNumber(-1), true
+}
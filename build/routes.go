@@ -2,12 +2,14 @@ package build
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/aarzilli/golua/lua"
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog/log"
 	"github.com/sosodev/heart/config"
 	"github.com/sosodev/heart/las"
+	"github.com/sosodev/heart/metrics"
 	"github.com/sosodev/heart/pool"
 )
 
@@ -15,6 +17,11 @@ var (
 	appConfig *config.Config = config.NewConfig()
 )
 
+var (
+	luaErrors   = metrics.NewCounter("heart_lua_errors_total", "Errors raised by Lua handlers")
+	luaTimeouts = metrics.NewCounter("heart_lua_timeouts_total", "Lua handlers aborted for running past their timeout")
+)
+
 // Routes for the *fiber.App from the initial *lua.State
 //
 // TODO:
@@ -33,17 +40,24 @@ func Routes(app *fiber.App, statePool *pool.Pool) {
 	// this does mean that only a single handler could be used but that's ideal anyway
 	var notFoundHandler func(*fiber.Ctx) error
 
+	// static mounts come first so files are served before the route handlers
+	registerSPAFallbacks := statics(app, state)
+	websockets(app, state, statePool)
+
 	loopRoutes(state, func(route string) {
 		state.PushNil()
 		defer state.Pop(1)
 
 		for state.Next(-2) != 0 {
 			method := state.ToString(-2)
+			timeout, timeoutSet := routeTimeout(state, route, method)
+			streamTimeout, streamTimeoutSet := routeStreamTimeout(state, route, method)
+			strict := timeoutSet || streamTimeoutSet
 			handler := func(ctx *fiber.Ctx) error {
-				return handleRequest(ctx, method, route, statePool)
+				return handleRequest(ctx, method, route, timeout, streamTimeout, strict, statePool)
 			}
 
-			log.Debug().Str("method", method).Str("route", route).Msg("Registering handler")
+			log.Debug().Str("method", method).Str("route", route).Str("timeout", timeout.String()).Bool("strict", strict).Msg("Registering handler")
 
 			switch method {
 			case "get":
@@ -70,6 +84,9 @@ func Routes(app *fiber.App, statePool *pool.Pool) {
 		}
 	})
 
+	// SPA fallbacks catch whatever the routes didn't so they go right before the 404 handler
+	registerSPAFallbacks()
+
 	// register the 404 handler if found
 	if notFoundHandler != nil {
 		app.Use(notFoundHandler)
@@ -77,8 +94,14 @@ func Routes(app *fiber.App, statePool *pool.Pool) {
 }
 
 // handle an incoming request with Lua
-func handleRequest(ctx *fiber.Ctx, method string, route string, statePool *pool.Pool) error {
+// a timeout of 0 lets the handler run forever and the stream timeout is the same for a streamed response
+// strict routes set their own timeout so they run with LuaJIT's compiler off to make sure it can interrupt them
+func handleRequest(ctx *fiber.Ctx, method string, route string, timeout time.Duration, streamTimeout time.Duration, strict bool, statePool *pool.Pool) error {
 	reqState, err := statePool.Take()
+	if err == pool.ErrExhausted {
+		log.Warn().Str("method", method).Str("route", route).Msg("Lua state pool exhausted")
+		return fiber.NewError(fiber.StatusServiceUnavailable, "503 - Service Unavailable")
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to take request state")
 
@@ -89,9 +112,16 @@ func handleRequest(ctx *fiber.Ctx, method string, route string, statePool *pool.
 		return err
 	}
 	releaseState := false
+	discarded := false
+	streaming := false
 	defer func() {
+		// a streaming response detaches the state from the pool and the stream closes it when it's done
+		if streaming || discarded {
+			return
+		}
+
 		if releaseState {
-			reqState.Close()
+			statePool.Discard(reqState)
 		} else {
 			statePool.Return(reqState)
 		}
@@ -112,14 +142,14 @@ func handleRequest(ctx *fiber.Ctx, method string, route string, statePool *pool.
 		return err
 	}
 
-	// load the callback
+	// load the dispatcher which runs the middleware chain and then the route callback
 	reqState.GetGlobal("_heart")
 	initialTop := reqState.GetTop()
-	reqState.GetField(initialTop, "routes")
-	reqState.GetField(initialTop+1, route)
-	reqState.GetField(initialTop+2, method)
+	reqState.GetField(initialTop, "dispatch")
+	reqState.PushString(route)
+	reqState.PushString(method)
 
-	// load the context module as the only argument
+	// load the context module as the last argument
 	// look, I know what you're thinking
 	// "Wait a minute... That context module could be required in the user code, right?"
 	// To which I would say: well yes, of course it could be and that would probably be more efficient
@@ -127,23 +157,108 @@ func handleRequest(ctx *fiber.Ctx, method string, route string, statePool *pool.
 	// Heart is kind of unique in the way that it could seemingly bind global state to a parallel request
 	// and that's just a little weird when our brains are wired to think statelessly 🤷
 	reqState.GetField(initialTop, "ctx")
-	err = reqState.Call(1, 1)
-	if err != nil {
+
+	if strict {
+		interpret(reqState)
+	}
+
+	hooked, err := callWithTimeout(reqState, 3, 3, timeout)
+	if hooked {
+		// the hook is still set on the state so it can't go back into the pool
 		releaseState = true
+	}
+
+	if err == errTimedOut {
+		luaTimeouts.Inc()
+		log.Error().Str("method", method).Str("route", route).Str("timeout", timeout.String()).Msg("Lua handler timed out")
+		return fiber.NewError(fiber.StatusServiceUnavailable, "503 - Service Unavailable")
+	}
+
+	if err != nil {
+		luaErrors.Inc()
 
 		log.Error().Err(err).Msg("Lua failed to handle request")
 
-		if appConfig.Production {
-			return fmt.Errorf("500 - Internal Server Error")
+		// the failed state may be corrupted so it's discarded before the error handler takes another one
+		// otherwise a full pool would make the error handler wait on the state it's replacing
+		discarded = true
+		statePool.Discard(reqState)
+
+		return handleError(ctx, err, timeout, strict, statePool)
+	}
+
+	err = respond(ctx, reqState)
+	reqState.Pop(1) // normally I'd defer this pop closer to the stack growth but I've found it makes debugging hard
+
+	// the stream is set up either way so a callback left over from this request can't leak into the next one
+	streaming, streamErr := stream(ctx, route, reqState, streamTimeout, statePool)
+	if err == nil {
+		err = streamErr
+	}
+
+	return err
+}
+
+// respond to the request with the body, status and headers table on top of the stack and pop them
+// the dispatchers always hand back all three though any of them can be nil
+func respond(ctx *fiber.Ctx, state *lua.State) error {
+	top := state.GetTop()
+	defer state.Pop(3)
+
+	if state.Type(top-1) == lua.LUA_TNUMBER {
+		ctx.Status(state.ToInteger(top - 1))
+	}
+
+	if state.IsTable(top) {
+		state.PushNil()
+		for state.Next(top) != 0 {
+			// non-string keys are skipped because converting them in place would break the traversal
+			if state.Type(-2) == lua.LUA_TSTRING {
+				ctx.Set(state.ToString(-2), state.ToString(-1))
+			}
+			state.Pop(1)
 		}
+	}
 
-		return err
+	// a nil body leaves the response alone so handlers that already sent or redirected aren't clobbered
+	if state.IsNil(top - 2) {
+		return nil
 	}
 
-	response := reqState.ToString(reqState.GetTop())
-	reqState.Pop(4) // normally I'd defer this pop closer to the stack growth but I've found it makes debugging hard
+	return ctx.Send(state.ToBytes(top - 2))
+}
+
+// get the timeout for the route from its options falling back to the global timeout
+// the second return value is true when the route set its own timeout
+func routeTimeout(state *lua.State, route string, method string) (time.Duration, bool) {
+	return routeDuration(state, route, method, "timeout", appConfig.RequestTimeout)
+}
+
+// get the timeout for the route's streamed responses from its options falling back to the global stream timeout
+// the second return value is true when the route set its own stream timeout
+func routeStreamTimeout(state *lua.State, route string, method string) (time.Duration, bool) {
+	return routeDuration(state, route, method, "streamTimeout", appConfig.StreamTimeout)
+}
+
+// get a duration in seconds from the route's options or the fallback if it isn't set
+// the second return value is false when the fallback was used
+func routeDuration(state *lua.State, route string, method string, key string, fallback time.Duration) (time.Duration, bool) {
+	state.GetGlobal("_heart")
+	state.GetField(-1, "options")
+	state.GetField(-1, route)
+	state.GetField(-1, method)
+	defer state.Pop(4)
+
+	if !state.IsTable(-1) {
+		return fallback, false
+	}
+
+	seconds, ok := optionNumber(state, state.GetTop(), key)
+	if !ok {
+		return fallback, false
+	}
 
-	return ctx.SendString(response)
+	return time.Duration(seconds * float64(time.Second)), true
 }
 
 // loop the routes built up in the app global variable
@@ -0,0 +1,359 @@
+package build_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sosodev/heart/build"
+	"github.com/sosodev/heart/config"
+	"github.com/sosodev/heart/kv"
+	"github.com/sosodev/heart/modules"
+	"github.com/sosodev/heart/pool"
+	"github.com/sosodev/heart/pubsub"
+)
+
+// newApp serves the Lua app from a pool with a single state so anything that leaks it shows up in the next request
+func newApp(t *testing.T, source string) *fiber.App {
+	app := fiber.New()
+	build.Routes(app, newPool(t, source))
+
+	return app
+}
+
+// newPool of a single state running the Lua app
+func newPool(t *testing.T, source string) *pool.Pool {
+	os.Setenv("DB_PATH", t.TempDir())
+	t.Cleanup(func() {
+		os.Unsetenv("DB_PATH")
+	})
+	t.Cleanup(kv.CloseStores)
+
+	path := filepath.Join(t.TempDir(), "main.lua")
+	err := ioutil.WriteFile(path, []byte(source), 0644)
+	if err != nil {
+		t.Fatalf("failed to write the app: %s", err)
+	}
+
+	statePool, err := pool.New(&config.Config{
+		Path:            path,
+		InitialPoolSize: 1,
+		PoolMinSize:     1,
+		PoolMaxSize:     1,
+		PoolMaxWaiters:  8,
+		PoolWaitTimeout: 5 * time.Second,
+		PoolIdleTimeout: time.Minute,
+		PoolRecycleAt:   10000,
+	}, func(state *lua.State) error {
+		for _, load := range []func(*lua.State) error{modules.LoadJSON, modules.LoadContext, modules.LoadKV, modules.LoadPubSub, modules.LoadWebsocket, modules.LoadHeart} {
+			err := load(state)
+			if err != nil {
+				return err
+			}
+		}
+
+		return state.DoFile(path)
+	})
+	if err != nil {
+		t.Fatalf("failed to create the pool: %s", err)
+	}
+	t.Cleanup(statePool.Close)
+
+	return statePool
+}
+
+// get the path and return the response's status and body
+func get(t *testing.T, app *fiber.App, path string) (int, string) {
+	resp, err := app.Test(httptest.NewRequest("GET", path, nil), 10000)
+	if err != nil {
+		t.Fatalf("GET %s failed: %s", path, err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the body of GET %s: %s", path, err)
+	}
+
+	return resp.StatusCode, string(body)
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	if os.Getenv("REQUEST_TIMEOUT") != "" {
+		t.Skip("REQUEST_TIMEOUT is set")
+	}
+
+	app := newApp(t, `
+		local app = require('heart.v1')
+
+		app.get('/loop', function(ctx)
+			while true do end
+		end, {timeout = 0.1})
+
+		app.get('/', function(ctx)
+			return 'ok'
+		end)
+	`)
+
+	// enough iterations for LuaJIT to compile the loop if it could
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		status, _ := get(t, app, "/loop")
+		if status != fiber.StatusServiceUnavailable {
+			t.Fatalf("the loop should time out with a 503 but got %d", status)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("the loop ran for %s past its 100ms timeout", elapsed)
+		}
+
+		// the timed out state is replaced so the single state pool keeps serving
+		status, body := get(t, app, "/")
+		if status != fiber.StatusOK || body != "ok" {
+			t.Fatalf("the pool didn't recover from the timeout: %d %q", status, body)
+		}
+	}
+}
+
+func TestErrorHandlerAfterFailure(t *testing.T) {
+	app := newApp(t, `
+		local app = require('heart.v1')
+
+		app.error(function(ctx, err)
+			return 'handled', 500
+		end)
+
+		app.get('/fail', function(ctx)
+			error('boom')
+		end)
+	`)
+
+	// with a single state the error handler can only run once the failed state is out of the pool
+	status, body := get(t, app, "/fail")
+	if status != fiber.StatusInternalServerError || body != "handled" {
+		t.Errorf("the error handler should handle the failure: %d %q", status, body)
+	}
+}
+
+func TestStream(t *testing.T) {
+	app := newApp(t, `
+		local app = require('heart.v1')
+
+		app.get('/stream', function(ctx)
+			ctx.stream(function(write)
+				for i = 1, 3 do
+					write('chunk ' .. i .. '\n')
+				end
+			end, 'text/plain')
+		end)
+
+		app.get('/ctx', function(ctx)
+			ctx.stream(function(write)
+				local ok, err = unsafe_pcall(ctx.path)
+				write(tostring(ok) .. ' ' .. tostring(err))
+			end)
+		end)
+
+		app.get('/', function(ctx)
+			return 'ok'
+		end)
+	`)
+
+	status, body := get(t, app, "/stream")
+	if status != fiber.StatusOK || body != "chunk 1\nchunk 2\nchunk 3\n" {
+		t.Errorf("unexpected stream: %d %q", status, body)
+	}
+
+	// the request is over by the time the callback runs so ctx raises an error instead of crashing
+	status, body = get(t, app, "/ctx")
+	if status != fiber.StatusOK || !strings.HasPrefix(body, "false ") || !strings.Contains(body, "ctx can only be used while handling a request") {
+		t.Errorf("ctx should raise an error in a stream: %d %q", status, body)
+	}
+
+	// the streams ran on detached state so the single state pool keeps serving
+	status, body = get(t, app, "/")
+	if status != fiber.StatusOK || body != "ok" {
+		t.Errorf("the pool didn't recover from the streams: %d %q", status, body)
+	}
+}
+
+func TestSSE(t *testing.T) {
+	app := newApp(t, `
+		local app = require('heart.v1')
+
+		app.get('/events', function(ctx)
+			ctx.sse(function(send)
+				send('hello\nworld', {event = 'greeting', id = 1})
+				send({n = 'two'}, {retry = 500})
+			end)
+		end)
+	`)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/events", nil), 10000)
+	if err != nil {
+		t.Fatalf("GET /events failed: %s", err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the body of GET /events: %s", err)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("expected an event stream but got %q", contentType)
+	}
+
+	expected := "event: greeting\nid: 1\ndata: hello\ndata: world\n\nretry: 500\ndata: {\"n\":\"two\"}\n\n"
+	if string(body) != expected {
+		t.Errorf("expected events %q but got %q", expected, string(body))
+	}
+}
+
+func TestStreamTimeout(t *testing.T) {
+	app := newApp(t, `
+		local app = require('heart.v1')
+
+		app.get('/forever', function(ctx)
+			ctx.stream(function(write)
+				write('started\n')
+				while true do end
+			end)
+		end, {streamTimeout = 0.1})
+	`)
+
+	start := time.Now()
+	status, body := get(t, app, "/forever")
+	if status != fiber.StatusOK || body != "started\n" {
+		t.Errorf("the stream should end at its timeout: %d %q", status, body)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the stream ran for %s past its 100ms timeout", elapsed)
+	}
+}
+
+func TestSubscribeTimeout(t *testing.T) {
+	app := newApp(t, `
+		local app = require('heart.v1')
+		local pubsub = require('heart.v1.pubsub')
+
+		app.get('/wait', function(ctx)
+			pubsub.subscribe('test:wait', function(message)
+				return true
+			end)
+		end, {timeout = 0.2})
+
+		app.get('/leak', function(ctx)
+			pubsub.subscribe('test:leak')
+			return 'subscribed'
+		end)
+	`)
+
+	// waiting on a message is interrupted by the timeout like any other Lua
+	start := time.Now()
+	status, _ := get(t, app, "/wait")
+	if status != fiber.StatusServiceUnavailable {
+		t.Errorf("waiting on a message should time out with a 503 but got %d", status)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the subscription waited for %s past its 200ms timeout", elapsed)
+	}
+
+	// a subscription the handler didn't close is closed when its state goes back into the pool
+	status, body := get(t, app, "/leak")
+	if status != fiber.StatusOK || body != "subscribed" {
+		t.Fatalf("unexpected response: %d %q", status, body)
+	}
+	if subscribers := pubsub.Default.Subscribers("test:leak"); subscribers != 0 {
+		t.Errorf("the subscription should be closed with the request but %d are left", subscribers)
+	}
+}
+
+func TestRespond(t *testing.T) {
+	app := newApp(t, `
+		local app = require('heart.v1')
+
+		app.get('/status', function(ctx)
+			return 'created', 201
+		end)
+
+		app.get('/headers', function(ctx)
+			return 'teapot', 418, {['X-Brew'] = 'earl grey'}
+		end)
+
+		app.get('/json', function(ctx)
+			return {message = 'hi'}
+		end)
+
+		app.get('/nil', function(ctx)
+			ctx.status(202)
+		end)
+	`)
+
+	status, body := get(t, app, "/status")
+	if status != fiber.StatusCreated || body != "created" {
+		t.Errorf("expected the body and status: %d %q", status, body)
+	}
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/headers", nil), 10000)
+	if err != nil {
+		t.Fatalf("GET /headers failed: %s", err)
+	}
+	if resp.StatusCode != fiber.StatusTeapot || resp.Header.Get("X-Brew") != "earl grey" {
+		t.Errorf("expected the status and headers: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/json", nil), 10000)
+	if err != nil {
+		t.Fatalf("GET /json failed: %s", err)
+	}
+	jsonBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the body of GET /json: %s", err)
+	}
+	if resp.Header.Get("Content-Type") != "application/json" || string(jsonBody) != `{"message":"hi"}` {
+		t.Errorf("tables should be sent as JSON: %q %q", resp.Header.Get("Content-Type"), jsonBody)
+	}
+
+	// a nil body leaves whatever the handler did to the response alone
+	status, body = get(t, app, "/nil")
+	if status != fiber.StatusAccepted || body != "" {
+		t.Errorf("a nil body should leave the response alone: %d %q", status, body)
+	}
+}
+
+func TestErrorHandlerTimeout(t *testing.T) {
+	app := newApp(t, `
+		local app = require('heart.v1')
+
+		app.error(function(ctx, err)
+			while true do end
+		end)
+
+		app.get('/fail', function(ctx)
+			error('boom')
+		end, {timeout = 0.1})
+
+		app.get('/', function(ctx)
+			return 'ok'
+		end)
+	`)
+
+	// the error handler gets the route's timeout and the built-in error page takes over once it's aborted
+	start := time.Now()
+	status, _ := get(t, app, "/fail")
+	if status != fiber.StatusInternalServerError {
+		t.Errorf("a looping error handler should fall back to a 500 but got %d", status)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the error handler ran for %s past its 100ms timeout", elapsed)
+	}
+
+	status, body := get(t, app, "/")
+	if status != fiber.StatusOK || body != "ok" {
+		t.Errorf("the pool didn't recover from the error handler timing out: %d %q", status, body)
+	}
+}
@@ -0,0 +1,88 @@
+package build
+
+import (
+	"path"
+	"path/filepath"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// staticMount is a single app.static call pulled out of the Lua state
+type staticMount struct {
+	route    string
+	filepath string
+	options  fiber.Static
+	spa      bool
+}
+
+// statics registers every static mount on the *fiber.App
+// and returns a function that registers their SPA fallbacks
+// the fallbacks are split out so they can be registered after the routes without shadowing them
+// files and fallbacks are served by fiber directly so the Lua middleware doesn't run for them
+func statics(app *fiber.App, state *lua.State) func() {
+	mounts := loopStatics(state)
+
+	for _, mount := range mounts {
+		log.Debug().Str("route", mount.route).Str("filepath", mount.filepath).Msg("Registering static mount")
+		app.Static(mount.route, mount.filepath, mount.options)
+	}
+
+	return func() {
+		for _, mount := range mounts {
+			if !mount.spa {
+				continue
+			}
+
+			// the handler outlives the loop so it can't hold on to mount
+			compress := mount.options.Compress
+			index := mount.options.Index
+			if index == "" {
+				index = "index.html"
+			}
+			indexPath := filepath.Join(mount.filepath, index)
+
+			log.Debug().Str("route", mount.route).Str("index", indexPath).Msg("Registering SPA fallback")
+			app.Get(path.Join(mount.route, "*"), func(ctx *fiber.Ctx) error {
+				return ctx.SendFile(indexPath, compress)
+			})
+		}
+	}
+}
+
+// loop the static mounts built up in the app global variable
+func loopStatics(state *lua.State) []staticMount {
+	state.GetGlobal("_heart")
+	state.GetField(state.GetTop(), "statics")
+	defer state.Pop(2)
+
+	mounts := make([]staticMount, 0)
+	list := state.GetTop()
+	for i := 1; i <= int(state.ObjLen(list)); i++ {
+		state.RawGeti(list, i)
+		mount := state.GetTop()
+
+		route := optionString(state, mount, "route")
+		root := optionString(state, mount, "filepath")
+
+		state.GetField(mount, "options")
+		options := state.GetTop()
+		mounts = append(mounts, staticMount{
+			route:    route,
+			filepath: root,
+			options: fiber.Static{
+				Compress:  optionBool(state, options, "compress"),
+				ByteRange: optionBool(state, options, "byteRange"),
+				Browse:    optionBool(state, options, "browse"),
+				Index:     optionString(state, options, "index"),
+				MaxAge:    optionInt(state, options, "maxAge"),
+			},
+			spa: optionBool(state, options, "spa"),
+		})
+
+		state.Pop(2)
+	}
+
+	return mounts
+}
@@ -0,0 +1,61 @@
+package build_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// write the files into a new temporary directory and return its path
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, contents := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	return dir
+}
+
+func TestStatics(t *testing.T) {
+	assets := writeFiles(t, map[string]string{"style.css": "body {}"})
+	spa := writeFiles(t, map[string]string{"index.html": "<div id=app></div>", "main.js": "render()"})
+
+	app := newApp(t, fmt.Sprintf(`
+		local app = require('heart.v1')
+
+		app.static('/assets', %q)
+		app.static('/app', %q, {spa = true})
+
+		app.get('/app/api', function(ctx)
+			return 'api'
+		end)
+	`, assets, spa))
+
+	expected := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/assets/style.css", fiber.StatusOK, "body {}"},
+		{"/app/main.js", fiber.StatusOK, "render()"},
+		// unknown paths under the SPA mount fall back to its index
+		{"/app/users/42", fiber.StatusOK, "<div id=app></div>"},
+		// defined routes win over the fallback
+		{"/app/api", fiber.StatusOK, "api"},
+		// mounts without spa don't fall back
+		{"/assets/missing.css", fiber.StatusNotFound, ""},
+	}
+
+	for _, e := range expected {
+		status, body := get(t, app, e.path)
+		if status != e.status || (e.body != "" && body != e.body) {
+			t.Errorf("GET %s: expected %d %q but got %d %q", e.path, e.status, e.body, status, body)
+		}
+	}
+}
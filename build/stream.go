@@ -0,0 +1,100 @@
+package build
+
+import (
+	"bufio"
+	"sync"
+	"time"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/sosodev/heart/las"
+	"github.com/sosodev/heart/pool"
+)
+
+var (
+	// closed by CloseStreams to abort every stream
+	streamsClosed    = make(chan struct{})
+	closeStreamsOnce sync.Once
+)
+
+// CloseStreams aborts every streamed response that's running and any started after it
+// streams last for as long as the client keeps reading so the server has to end them for shutdown to drain
+func CloseStreams() {
+	closeStreamsOnce.Do(func() {
+		close(streamsClosed)
+	})
+}
+
+// stream the response with the callback the handler passed to ctx.stream or ctx.sse if it did
+// a stream lasts for as long as the client keeps reading so the state is detached from the pool for it
+// and closed when the callback returns, the caller must not touch the state when this returns true
+// the stream is turned away with a 503 while detached state is at its cap
+func stream(ctx *fiber.Ctx, route string, reqState *lua.State, timeout time.Duration, statePool *pool.Pool) (bool, error) {
+	as, ok := las.Get(reqState)
+	if !ok || as.Stream == 0 {
+		return false, nil
+	}
+
+	ref := as.Stream
+	as.Stream = 0
+
+	err := statePool.Detach(reqState)
+	if err != nil {
+		reqState.Unref(lua.LUA_REGISTRYINDEX, ref)
+		log.Warn().Str("route", route).Msg("Detached lua state exhausted")
+		return false, fiber.NewError(fiber.StatusServiceUnavailable, "503 - Service Unavailable")
+	}
+
+	// fiber reuses the *fiber.Ctx once the handler returns so the stream can't use it
+	as.Ctx = nil
+
+	// fasthttp runs the writer in its own goroutine right away and the writes block until the response is being sent
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer statePool.CloseDetached(reqState)
+
+		as.StreamWriter = w
+
+		reqState.RawGeti(lua.LUA_REGISTRYINDEX, ref)
+		reqState.Unref(lua.LUA_REGISTRYINDEX, ref)
+
+		_, err := callUntil(reqState, 0, 0, timeout, streamsClosed)
+		as.StreamWriter = nil
+
+		if err == nil {
+			return
+		}
+
+		if err == errTimedOut && isClosed(streamsClosed) {
+			log.Debug().Str("route", route).Msg("Closed stream for shutdown")
+			return
+		}
+
+		if err == errTimedOut {
+			luaTimeouts.Inc()
+			log.Error().Str("route", route).Str("timeout", timeout.String()).Msg("Lua stream timed out")
+			return
+		}
+
+		// writes fail once the client is gone which is how most streams end
+		if w.Flush() != nil {
+			log.Debug().Err(err).Str("route", route).Msg("Client disconnected from stream")
+			return
+		}
+
+		luaErrors.Inc()
+		log.Error().Err(err).Str("route", route).Str("traceback", traceback(stackTrace(err))).Msg("Lua failed to stream response")
+	})
+
+	return true, nil
+}
+
+// check if the channel has been closed without blocking
+func isClosed(channel <-chan struct{}) bool {
+	select {
+	case <-channel:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,95 @@
+package build
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/sosodev/heart/las"
+)
+
+// the status of a Lua call with a timeout
+const (
+	running int32 = iota
+	finished
+	timedOut
+)
+
+// errTimedOut is returned by callWithTimeout when the call was aborted for running past its timeout
+var errTimedOut = errors.New("Lua call timed out")
+
+// call the function and arguments on top of the stack like state.Call but abort it once the timeout has passed
+// a timeout of 0 lets it run forever
+// past the timeout an instruction hook is set that raises an error on the next Lua instruction
+// hooks only run in LuaJIT's interpreter so code it already compiled can run past the timeout unless interpret was called first
+// the first return value is true when the hook may have been set in which case the state can't go back into the pool
+func callWithTimeout(state *lua.State, nargs int, nresults int, timeout time.Duration) (bool, error) {
+	return callUntil(state, nargs, nresults, timeout, nil)
+}
+
+// callUntil is callWithTimeout that's also aborted as soon as stop is closed
+func callUntil(state *lua.State, nargs int, nresults int, timeout time.Duration, stop <-chan struct{}) (bool, error) {
+	if timeout <= 0 && stop == nil {
+		return false, state.Call(nargs, nresults)
+	}
+
+	// the status makes sure the hook is never set after the call has finished without us knowing
+	var status int32
+	abort := func() {
+		if atomic.CompareAndSwapInt32(&status, running, timedOut) {
+			state.SetExecutionLimit(1)
+		}
+	}
+
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, abort)
+		defer timer.Stop()
+	}
+
+	if stop != nil {
+		done := make(chan struct{})
+		defer close(done)
+
+		go func() {
+			select {
+			case <-stop:
+				abort()
+			case <-done:
+			}
+		}()
+	}
+
+	err := state.Call(nargs, nresults)
+	if atomic.CompareAndSwapInt32(&status, running, finished) {
+		return false, err
+	}
+
+	if err != nil {
+		return true, errTimedOut
+	}
+
+	return true, nil
+}
+
+// turn LuaJIT's compiler off for the state so a timeout is sure to interrupt it
+// hooks only run in the interpreter so a hot loop that's already been compiled could never be interrupted
+// the traces compiled before then are flushed for the same reason
+// it's only done for Lua that sets its own timeout since the state stays slower for the rest of its life
+func interpret(state *lua.State) {
+	as, ok := las.Get(state)
+	if ok && as.Interpreted {
+		return
+	}
+
+	// plain Lua doesn't have the jit module so there's nothing to do
+	err := state.DoString("if jit then jit.off() jit.flush() end")
+	if err != nil {
+		return
+	}
+
+	_ = las.Update(state, func(as *las.AssociatedState) error {
+		as.Interpreted = true
+		return nil
+	})
+}
@@ -0,0 +1,121 @@
+package build
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sosodev/heart/kv"
+	"github.com/sosodev/heart/las"
+	"github.com/sosodev/heart/pool"
+)
+
+// Watchers subscribes to the KV writes watched by the app with kv.watch
+// every write is handed to the watcher's callback on a state taken from the pool
+// returns a function that stops every watcher which must be called before the pool is closed
+func Watchers(statePool *pool.Pool) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	state, err := statePool.Take()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to retrieve initial lua state")
+	}
+	defer statePool.Return(state)
+
+	state.GetGlobal("_kv_watchers")
+	watchers := state.GetTop()
+	defer state.Pop(1)
+
+	if !state.IsTable(watchers) {
+		return cancel
+	}
+
+	// every state ran the same app so the watcher at each index is the same in all of them
+	for index := 1; index <= int(state.ObjLen(watchers)); index++ {
+		state.RawGeti(watchers, index)
+		watcher := state.GetTop()
+
+		state.GetField(watcher, "db")
+		store, ok := state.ToGoStruct(-1).(*kv.KV)
+		state.GetField(watcher, "prefix")
+		prefix := state.ToString(-1)
+		state.GetField(watcher, "options")
+		timeout := appConfig.RequestTimeout
+		seconds, strict := optionNumber(state, state.GetTop(), "timeout")
+		if strict {
+			timeout = time.Duration(seconds * float64(time.Second))
+		}
+		state.Pop(4)
+
+		if !ok {
+			log.Error().Int("watcher", index).Str("prefix", prefix).Msg("kv.watch wasn't given a store")
+			continue
+		}
+
+		pairs, err := store.Subscribe(ctx, prefix)
+		if err != nil {
+			log.Error().Err(err).Int("watcher", index).Str("prefix", prefix).Msg("Failed to watch KV")
+			continue
+		}
+
+		log.Debug().Int("watcher", index).Str("prefix", prefix).Str("timeout", timeout.String()).Msg("Watching KV")
+		go watch(index, timeout, strict, pairs, statePool)
+	}
+
+	return cancel
+}
+
+// hand every pair to the watcher's callback in order until the subscription ends
+// watchers that set their own timeout are strict about it like routes are
+func watch(index int, timeout time.Duration, strict bool, pairs <-chan kv.Pair, statePool *pool.Pool) {
+	for pair := range pairs {
+		err := dispatchWatch(index, timeout, strict, pair, statePool)
+		if err == errTimedOut {
+			luaTimeouts.Inc()
+			log.Error().Int("watcher", index).Str("key", pair.Key).Str("timeout", timeout.String()).Msg("KV watcher timed out")
+			continue
+		}
+		if err != nil {
+			log.Error().Err(err).Int("watcher", index).Str("key", pair.Key).Str("traceback", traceback(stackTrace(err))).Msg("KV watcher failed")
+		}
+	}
+}
+
+func dispatchWatch(index int, timeout time.Duration, strict bool, pair kv.Pair, statePool *pool.Pool) error {
+	state, err := statePool.Take()
+	if err != nil {
+		return err
+	}
+
+	// watchers aren't part of a request so they don't get a ctx and using one raises an error
+	err = las.Update(state, func(as *las.AssociatedState) error {
+		as.Ctx = nil
+		return nil
+	})
+	if err != nil {
+		statePool.Return(state)
+		return err
+	}
+
+	state.GetGlobal("_kv_watchers")
+	state.RawGeti(-1, index)
+	state.GetField(-1, "callback")
+	state.PushString(pair.Key)
+	state.PushString(pair.Value)
+
+	if strict {
+		interpret(state)
+	}
+
+	hooked, err := callWithTimeout(state, 2, 0, timeout)
+	if hooked || err != nil {
+		// the state may be corrupted after an error or still have the timeout's hook set
+		statePool.Discard(state)
+		return err
+	}
+
+	state.Pop(2)
+	statePool.Return(state)
+
+	return nil
+}
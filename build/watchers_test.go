@@ -0,0 +1,84 @@
+package build_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sosodev/heart/build"
+	"github.com/sosodev/heart/kv"
+	"github.com/sosodev/heart/pubsub"
+)
+
+func TestWatchers(t *testing.T) {
+	statePool := newPool(t, `
+		local ctx = require('heart.v1.context')
+		local kv = require('heart.v1.kv.memory')
+		local pubsub = require('heart.v1.pubsub')
+
+		kv.watch('watched:', function(key, value)
+			local ok, err = unsafe_pcall(ctx.path)
+			pubsub.publish('test:watchers', key .. '=' .. value .. ' ' .. tostring(ok) .. ' ' .. tostring(err))
+		end)
+
+		-- any number of watchers can watch the same prefix
+		kv.watch('watched:', function(key, value)
+			pubsub.publish('test:watchers', 'again ' .. key)
+		end)
+
+		kv.watch('stuck:', function(key, value)
+			while true do end
+		end, {timeout = 0.1})
+	`)
+
+	subscription := pubsub.Default.Subscribe("test:watchers")
+	defer subscription.Close()
+
+	stop := build.Watchers(statePool)
+	defer stop()
+
+	store, err := kv.GetMemoryStore()
+	if err != nil {
+		t.Fatalf("failed to get memory store: %s", err)
+	}
+
+	for _, key := range []string{"stuck:1", "watched:1"} {
+		txn, err := store.StartTransaction()
+		if err != nil {
+			t.Fatalf("failed to start transaction: %s", err)
+		}
+
+		err = txn.Set(key, "value")
+		if err != nil {
+			t.Fatalf("failed to set key: %s", err)
+		}
+
+		err = txn.Commit()
+		if err != nil {
+			t.Fatalf("failed to commit transaction: %s", err)
+		}
+	}
+
+	// the stuck watcher times out and gives its state back so the single state pool can run the others
+	// the watchers of the same prefix run in parallel so their messages can come in either order
+	messages := make([]string, 0, 2)
+	for len(messages) < 2 {
+		message, err := subscription.Receive(10 * time.Second)
+		if err != nil {
+			t.Fatalf("the watchers didn't run: %s", err)
+		}
+		messages = append(messages, message)
+	}
+
+	watched, again := messages[0], messages[1]
+	if strings.HasPrefix(watched, "again ") {
+		watched, again = again, watched
+	}
+
+	if !strings.HasPrefix(watched, "watched:1=value false ") || !strings.Contains(watched, "ctx can only be used while handling a request") {
+		t.Errorf("the watcher should get the write and an error from ctx but got %q", watched)
+	}
+	if again != "again watched:1" {
+		t.Errorf("the second watcher of the prefix should get the write too but got %q", again)
+	}
+}
@@ -0,0 +1,123 @@
+package build
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/sosodev/heart/las"
+	"github.com/sosodev/heart/modules"
+	"github.com/sosodev/heart/pool"
+)
+
+// how long to wait on writing the close message when a websocket callback returns
+const websocketCloseTimeout = time.Second
+
+// the connections whose callbacks are running so they can be closed on shutdown
+var openWebsockets sync.Map
+
+// register the websocket routes built up in the app global variable
+// they go in before the other routes so a plain GET handler on the same path still gets the requests that aren't upgrades
+func websockets(app *fiber.App, state *lua.State, statePool *pool.Pool) {
+	state.GetGlobal("_heart")
+	state.GetField(-1, "websockets")
+	state.PushNil()
+
+	for state.Next(-2) != 0 {
+		route := state.ToString(-2)
+		upgrade := websocket.New(handleWebsocket(route, statePool))
+
+		log.Debug().Str("route", route).Msg("Registering websocket handler")
+
+		app.Get(route, func(ctx *fiber.Ctx) error {
+			if !websocket.IsWebSocketUpgrade(ctx) {
+				return ctx.Next()
+			}
+
+			// connections are turned away before the upgrade while the detached state is at its cap
+			if !statePool.DetachedAvailable() {
+				log.Warn().Str("route", route).Msg("Detached lua state exhausted")
+				return fiber.NewError(fiber.StatusServiceUnavailable, "503 - Service Unavailable")
+			}
+
+			modules.CaptureUpgradeRequest(ctx)
+			return upgrade(ctx)
+		})
+
+		state.Pop(1)
+	}
+
+	state.Pop(2)
+}
+
+// run the websocket route's callback for an upgraded connection
+// a connection can stay open for as long as the client likes so it gets its own detached state instead of holding one from the pool
+func handleWebsocket(route string, statePool *pool.Pool) func(*websocket.Conn) {
+	return func(conn *websocket.Conn) {
+		closeCode := websocket.CloseNormalClosure
+		defer func() {
+			// the callback may have closed the connection already in which case this fails harmlessly
+			_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, ""), time.Now().Add(websocketCloseTimeout))
+		}()
+
+		// the cap was checked before the upgrade but other connections may have taken the last of it since
+		state, err := statePool.NewDetached()
+		if err == pool.ErrDetachedExhausted {
+			closeCode = websocket.CloseTryAgainLater
+			log.Warn().Str("route", route).Msg("Detached lua state exhausted")
+			return
+		}
+		if err != nil {
+			closeCode = websocket.CloseInternalServerErr
+			log.Error().Err(err).Str("route", route).Msg("Failed to create websocket state")
+			return
+		}
+		defer statePool.CloseDetached(state)
+
+		openWebsockets.Store(conn, struct{}{})
+		defer openWebsockets.Delete(conn)
+
+		err = las.Update(state, func(as *las.AssociatedState) error {
+			as.Websocket = conn
+			return nil
+		})
+		if err != nil {
+			closeCode = websocket.CloseInternalServerErr
+			log.Error().Err(err).Str("route", route).Msg("Failed to update associated state for websocket")
+			return
+		}
+
+		state.GetGlobal("_heart")
+		state.GetField(-1, "dispatchWebsocket")
+		state.PushString(route)
+
+		err = state.Call(1, 0)
+		if err != nil {
+			closeCode = websocket.CloseInternalServerErr
+			luaErrors.Inc()
+			log.Error().Err(err).Str("route", route).Str("traceback", traceback(stackTrace(err))).Msg("Lua failed to handle websocket")
+			return
+		}
+
+		state.Pop(1)
+	}
+}
+
+// CloseWebsockets tells every open websocket the server is going away and closes it
+// the callbacks see the connection closed, like when the client leaves, so their detached state is closed once they return
+func CloseWebsockets() {
+	openWebsockets.Range(func(key, _ interface{}) bool {
+		conn := key.(*websocket.Conn)
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(websocketCloseTimeout))
+
+		err := conn.Close()
+		if err != nil {
+			log.Debug().Err(err).Msg("Failed to close websocket")
+		}
+
+		return true
+	})
+}
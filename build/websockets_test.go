@@ -0,0 +1,95 @@
+package build_test
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sosodev/heart/build"
+)
+
+func TestWebsocket(t *testing.T) {
+	statePool := newPool(t, `
+		local app = require('heart.v1')
+
+		app.websocket('/ws/:room', function(ws)
+			ws.send(ws.ctx.pathParam('room') .. ' ' .. ws.ctx.path() .. ' ' .. ws.ctx.headers('X-Client'))
+
+			while true do
+				local message = ws.receive()
+				if message == nil then
+					return
+				end
+
+				ws.send('echo ' .. message)
+			end
+		end)
+
+		app.get('/', function(ctx)
+			return 'ok'
+		end)
+	`)
+
+	app := fiber.New()
+	build.Routes(app, statePool)
+
+	// upgrades need a real connection so the app can't be tested with app.Test
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	go func() {
+		_ = app.Listener(listener)
+	}()
+	defer app.Shutdown()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+listener.Addr().String()+"/ws/lobby", http.Header{"X-Client": []string{"tester"}})
+	if err != nil {
+		t.Fatalf("failed to dial the websocket: %s", err)
+	}
+	defer conn.Close()
+
+	_, greeting, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read the greeting: %s", err)
+	}
+	if string(greeting) != "lobby /ws/lobby tester" {
+		t.Errorf("the callback should see the path params, path and headers of the upgrade but sent %q", greeting)
+	}
+
+	err = conn.WriteMessage(websocket.TextMessage, []byte("ping"))
+	if err != nil {
+		t.Fatalf("failed to send a message: %s", err)
+	}
+
+	_, echo, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read the echo: %s", err)
+	}
+	if string(echo) != "echo ping" {
+		t.Errorf("expected the message to be echoed but got %q", echo)
+	}
+
+	if detached := statePool.Stats().Detached; detached != 1 {
+		t.Errorf("the connection should run on its own detached state but %d are open", detached)
+	}
+
+	// closing the connection ends the callback which closes its detached state
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for statePool.Stats().Detached != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the detached state wasn't closed with the connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the connection never held the single pooled state so requests are still served
+	status, body := get(t, app, "/")
+	if status != fiber.StatusOK || body != "ok" {
+		t.Errorf("the pool should keep serving after the websocket: %d %q", status, body)
+	}
+}
@@ -0,0 +1,153 @@
+// Package cli holds the subcommands that run instead of the server
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sosodev/heart/config"
+	"github.com/sosodev/heart/kv"
+)
+
+const kvUsage = `Usage: heart kv <command> [options] [file]
+
+Commands:
+  backup [--store name] [--since version] <file>   write a backup of the store
+  restore [--store name] <file>                    load a backup into the store
+  export [--store name] [--format jsonl] [file]    write every pair as JSON lines, defaults to stdout
+  import [--store name] [--format jsonl] [file]    read pairs written by export, defaults to stdin
+
+The store defaults to the disk store at DB_PATH and --store picks a named disk store instead.
+A file of - is stdin or stdout. Badger locks the store so the server can't be running against it.
+`
+
+// KV runs the heart kv subcommand with the arguments that come after kv
+func KV(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, kvUsage)
+		return fmt.Errorf("missing kv command")
+	}
+
+	command := args[0]
+	flags := flag.NewFlagSet("heart kv "+command, flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, kvUsage) }
+	storeName := flags.String("store", "", "named disk store to use instead of the one at DB_PATH")
+	format := flags.String("format", "jsonl", "format for export and import")
+	since := flags.Uint64("since", 0, "only back up versions newer than this one")
+
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	if *format != "jsonl" {
+		return fmt.Errorf("unsupported format %q, only jsonl is supported", *format)
+	}
+
+	file := flags.Arg(0)
+	switch command {
+	case "backup", "restore":
+		if file == "" {
+			flags.Usage()
+			return fmt.Errorf("kv %s needs a file", command)
+		}
+	case "export", "import":
+		if file == "" {
+			file = "-"
+		}
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown kv command %q", command)
+	}
+
+	store, err := openStore(*storeName)
+	if err != nil {
+		return err
+	}
+	defer kv.CloseStores()
+
+	switch command {
+	case "backup":
+		return withOutput(file, func(w io.Writer) error {
+			version, err := store.Backup(w, *since)
+			if err != nil {
+				return err
+			}
+
+			log.Info().Uint64("version", version).Msg("Backup complete, pass the version as --since for an incremental backup")
+			return nil
+		})
+	case "restore":
+		return withInput(file, func(r io.Reader) error {
+			err := store.Load(r)
+			if err != nil {
+				return err
+			}
+
+			log.Info().Msg("Restore complete")
+			return nil
+		})
+	case "export":
+		return withOutput(file, store.Export)
+	default:
+		return withInput(file, func(r io.Reader) error {
+			count, err := store.Import(r)
+			if err != nil {
+				return err
+			}
+
+			log.Info().Int("pairs", count).Msg("Import complete")
+			return nil
+		})
+	}
+}
+
+// open the disk store at DB_PATH or the named disk store
+func openStore(name string) (*kv.KV, error) {
+	if name == "" {
+		return kv.GetDiskStore()
+	}
+
+	return kv.Open(name, kv.StoreOptions{
+		Medium:     "disk",
+		SyncWrites: config.NewConfig().DBSyncWrites,
+	})
+}
+
+// run fn with the file opened for writing or stdout for -
+func withOutput(file string, fn func(io.Writer) error) error {
+	if file == "-" {
+		return fn(os.Stdout)
+	}
+
+	output, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	err = fn(output)
+	if err != nil {
+		output.Close()
+		return err
+	}
+
+	return output.Close()
+}
+
+// run fn with the file opened for reading or stdin for -
+func withInput(file string, fn func(io.Reader) error) error {
+	if file == "-" {
+		return fn(os.Stdin)
+	}
+
+	input, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	return fn(input)
+}
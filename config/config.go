@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -12,24 +13,42 @@ import (
 type Config struct {
 	Production      bool
 	Profile         bool
+	Metrics         bool
+	Watch           bool
 	Path            string
 	DBPath          string
 	Version         string
 	InitialPoolSize int
+	PoolMinSize     int
+	PoolMaxSize     int
+	PoolMaxWaiters  int
+	PoolMaxDetached int
+	PoolWaitTimeout time.Duration
+	PoolIdleTimeout time.Duration
+	PoolRecycleAt   int32
 	Port            string
 	DBSyncWrites    bool
+	BodyLimit       int
+	RequestTimeout  time.Duration
+	StreamTimeout   time.Duration
+	ShutdownTimeout time.Duration
+	SecretKey       string
 	LogLevel        zerolog.Level
 }
 
 // NewConfig gets you a new *Config
 func NewConfig() *Config {
 	if len(os.Args) < 2 {
-		log.Fatal().Msg("Usage: heart [path]")
+		log.Fatal().Msg("Usage: heart [path] or heart kv <command>")
 	}
 	path := os.Args[1]
 
 	production := os.Getenv("PROD") == "true"
 	profile := os.Getenv("PROFILE") == "true"
+	metrics := os.Getenv("METRICS") == "true"
+
+	// reloading the app on changes is only for development
+	watch := !production && os.Getenv("WATCH") == "true"
 
 	dbPath := os.Getenv("DB_PATH")
 	if len(dbPath) == 0 {
@@ -51,8 +70,49 @@ func NewConfig() *Config {
 		log.Fatal().Msg("Env variable INITIAL_POOL_SIZE should be an integer")
 	}
 
+	// the pool never shrinks below its min size and never grows past its max size
+	// a max size of 0 lets it grow without bound
+	poolMinSize := intEnv("POOL_MIN_SIZE", initialPoolSize)
+	poolMaxSize := intEnv("POOL_MAX_SIZE", 256)
+	if poolMaxSize > 0 && poolMinSize > poolMaxSize {
+		log.Fatal().Msg("Env variable POOL_MIN_SIZE can't be larger than POOL_MAX_SIZE")
+	}
+
+	// requests wait in a bounded queue for state once the pool is at its max size
+	poolMaxWaiters := intEnv("POOL_MAX_WAITERS", 1024)
+
+	// long lived work like websocket connections runs on state outside the pool which is capped separately
+	// a max of 0 lets it grow without bound
+	poolMaxDetached := intEnv("POOL_MAX_DETACHED", 256)
+	poolWaitTimeout := durationEnv("POOL_WAIT_TIMEOUT", "5s")
+
+	// idle state above the min size is closed after the idle timeout
+	// and state is recycled after it has been taken from the pool enough times
+	poolIdleTimeout := durationEnv("POOL_IDLE_TIMEOUT", "1m")
+	poolRecycleAt := intEnv("POOL_RECYCLE_AT", 10000)
+
 	dbSyncWrites := os.Getenv("DB_SYNC_WRITES") != "false"
 
+	// a timeout of 0 lets handlers run forever
+	// the global timeout leaves LuaJIT's compiler on so a hot loop it compiled may outrun it
+	// routes that set their own timeout turn the compiler off for their state so it always applies
+	requestTimeout := durationEnv("REQUEST_TIMEOUT", "0s")
+
+	// streamed responses run after the handler returns and get their own, longer, timeout
+	streamTimeout := durationEnv("STREAM_TIMEOUT", "1h")
+
+	// how long in-flight requests get to finish when the process is told to stop
+	// it should be shorter than the orchestrator's grace period so the KV stores are closed cleanly
+	shutdownTimeout := durationEnv("SHUTDOWN_TIMEOUT", "20s")
+
+	// the secret keys session cookies and signed or encrypted cookies so it has to be shared by every instance of the app
+	// in production sessions and signed or encrypted cookies raise an error without it
+	// in development a random one is generated the first time they're used
+	secretKey := os.Getenv("SECRET_KEY")
+
+	// the body limit also caps the size of multipart uploads
+	bodyLimit := intEnv("BODY_LIMIT", 4194304)
+
 	logLevel := zerolog.InfoLevel
 	switch os.Getenv("LOG_LEVEL") {
 	case "panic":
@@ -74,12 +134,56 @@ func NewConfig() *Config {
 	return &Config{
 		Production:      production,
 		Profile:         profile,
+		Metrics:         metrics,
+		Watch:           watch,
 		Path:            path,
 		Version:         "0.1",
 		InitialPoolSize: initialPoolSize,
+		PoolMinSize:     poolMinSize,
+		PoolMaxSize:     poolMaxSize,
+		PoolMaxWaiters:  poolMaxWaiters,
+		PoolMaxDetached: poolMaxDetached,
+		PoolWaitTimeout: poolWaitTimeout,
+		PoolIdleTimeout: poolIdleTimeout,
+		PoolRecycleAt:   int32(poolRecycleAt),
 		Port:            port,
 		DBPath:          dbPath,
 		DBSyncWrites:    dbSyncWrites,
+		BodyLimit:       bodyLimit,
+		RequestTimeout:  requestTimeout,
+		StreamTimeout:   streamTimeout,
+		ShutdownTimeout: shutdownTimeout,
+		SecretKey:       secretKey,
 		LogLevel:        logLevel,
 	}
 }
+
+// get an integer from the env variable or the fallback if it isn't set
+func intEnv(key string, fallback int) int {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+
+	integer, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatal().Msgf("Env variable %s should be an integer", key)
+	}
+
+	return integer
+}
+
+// get a duration from the env variable or the fallback if it isn't set
+func durationEnv(key string, fallback string) time.Duration {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		value = fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatal().Msgf("Env variable %s should be a duration like %s", key, fallback)
+	}
+
+	return duration
+}
@@ -7,5 +7,19 @@ end)
 
 -- set the cookie 'cookie' to the value of the query param 'value'
 app.post('/cookie', function(ctx)
-  ctx.cookies('cookie', ctx.queryParam('value'))
+  ctx.cookies('cookie', ctx.queryParam('value'), {path = '/', maxAge = 3600, httpOnly = true})
+end)
+
+-- signed and encrypted cookies are keyed with SECRET_KEY and read as nil once they've been tampered with
+app.get('/preferences', function(ctx)
+  return ctx.json({
+    theme = ctx.signedCookies('theme'),
+    note = ctx.encryptedCookies('note')
+  })
+end)
+
+app.post('/preferences', function(ctx)
+  local options = {path = '/', expires = os.time() + 30 * 24 * 60 * 60, httpOnly = true, sameSite = 'Strict'}
+  ctx.signedCookies('theme', ctx.queryParam('theme'), options)
+  ctx.encryptedCookies('note', ctx.queryParam('note'), options)
 end)
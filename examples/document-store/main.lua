@@ -8,15 +8,18 @@ app.post('/documents/:bucket/:id', function(ctx)
   local document = ctx.body().json().document
 
   if document == nil then
-    return ctx.status(400).json({error = 'missing JSON key \'document\''})
+    return {error = 'missing JSON key \'document\''}, 400
   end
 
-  kv.transaction(function(store)
+  local committed, err = kv.transaction(function(store)
     store.set(id, json.encode(document))
   end)
 
-  ctx.status(201)
-  return ''
+  if not committed then
+    return {error = err}, 500
+  end
+
+  return '', 201
 end)
 
 -- retrieve document in bucket
@@ -25,24 +28,39 @@ app.get('/documents/:bucket/:id', function(ctx)
   local document = kv.get(id)
 
   if document == '' then
-    return ctx.status(400).json({error = 'document not found'})
+    return {error = 'document not found'}, 400
   end
 
-  return ctx.json({document = document})
+  return {document = document}
 end)
 
 -- delete document in bucket
 app.delete('/documents/:bucket/:id', function(ctx)
   local id = ctx.pathParam('bucket') .. '_' .. ctx.pathParam('id')
 
-  kv.transaction(function(store)
+  local committed, err = kv.transaction(function(store)
     store.delete(id)
   end)
 
+  if not committed then
+    return {error = err}, 500
+  end
+
   return ''
 end)
 
--- list documents in bucket
+-- list documents in bucket a page at a time
+-- pass the returned cursor as ?cursor= to get the next page
 app.get('/documents/:bucket', function(ctx)
-  return ctx.json({documents = kv.listPairs(ctx.pathParam('bucket'), 10)})
+  local cursor = ctx.queryParam('cursor')
+  if cursor == '' then
+    cursor = nil
+  end
+
+  local documents, nextCursor, err = kv.scan({prefix = ctx.pathParam('bucket') .. '_', limit = 10, cursor = cursor})
+  if err ~= nil then
+    return {error = err}, 400
+  end
+
+  return {documents = documents, cursor = nextCursor}
 end)
@@ -0,0 +1,10 @@
+local app = require('heart.v1')
+
+-- render every error as JSON instead of the built-in error responses
+app.error(function(ctx, err)
+  return {error = err.message, traceback = err.traceback}
+end)
+
+app.get('/boom', function(ctx)
+  error('boom')
+end)
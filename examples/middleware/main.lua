@@ -0,0 +1,25 @@
+local app = require('heart.v1')
+
+-- tag every response with the server name
+app.after(function(ctx, response)
+  ctx.headers('X-Powered-By', 'heart')
+end)
+
+app.get('/', function(ctx)
+  return ctx.json({hello = 'world'})
+end)
+
+-- everything under /admin shares the prefix and the token check
+app.group('/admin', function(admin)
+  admin.use(function(ctx)
+    if ctx.headers('Authorization') ~= 'Bearer hunter2' then
+      return ctx.status(401).json({error = 'unauthorized'})
+    end
+
+    return ctx.next()
+  end)
+
+  admin.get('/stats', function(ctx)
+    return ctx.json({requests = 'lots'})
+  end)
+end)
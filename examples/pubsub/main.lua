@@ -0,0 +1,25 @@
+local app = require('heart.v1')
+local pubsub = require('heart.v1.pubsub')
+
+-- publish the request body to everyone listening on the feed
+-- try it with `curl -d 'hello' localhost:3333/messages`
+app.post('/messages', function(ctx)
+  local listeners = pubsub.publish('feed', ctx.body().string())
+  return {listeners = listeners}
+end)
+
+-- follow the feed as server-sent events with `curl -N localhost:3333/feed`
+app.get('/feed', function(ctx)
+  ctx.sse(function(send)
+    pubsub.subscribe('feed', function(message)
+      send(message, {event = 'message'})
+    end)
+  end)
+end)
+
+-- or over a websocket which stops once the client is gone
+app.websocket('/feed', function(ws)
+  pubsub.subscribe('feed', function(message)
+    return ws.send(message) == nil
+  end)
+end)
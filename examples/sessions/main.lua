@@ -0,0 +1,25 @@
+local app = require('heart.v1')
+local session = require('heart.v1.session')
+
+-- sessions live for an hour after they were last used
+-- set SECRET_KEY so the session cookies stay valid across restarts, it has to be set in production
+app.use(session.middleware({ttl = 3600}))
+
+app.get('/', function(ctx)
+  local visits = (ctx.session.get('visits') or 0) + 1
+  ctx.session.set('visits', visits)
+
+  return {user = ctx.session.get('user'), visits = visits}
+end)
+
+app.post('/login/:user', function(ctx)
+  -- a fresh id on login keeps an id planted before it from being reused
+  ctx.session.regenerate()
+  ctx.session.set('user', ctx.pathParam('user'))
+
+  return {user = ctx.pathParam('user')}
+end)
+
+app.post('/logout', function(ctx)
+  ctx.session.destroy()
+end)
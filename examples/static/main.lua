@@ -0,0 +1,14 @@
+local app = require('heart.v1')
+
+-- long lived, compressed assets
+app.static('/assets', './public/assets', {compress = true, byteRange = true, maxAge = 86400})
+
+-- browsable documentation
+app.static('/docs', './public/docs', {browse = true})
+
+-- single page app that handles its own routing under /app
+app.static('/app', './public/app', {spa = true})
+
+app.get('/api/health', function(ctx)
+  return {healthy = true}
+end)
@@ -0,0 +1,45 @@
+local app = require('heart.v1')
+local kv = require('heart.v1.kv.memory')
+local pubsub = require('heart.v1.pubsub')
+
+-- export every stored pair as CSV without building the whole file in memory
+app.get('/export.csv', function(ctx)
+  ctx.headers('Content-Disposition', 'attachment; filename="export.csv"')
+
+  ctx.stream(function(write)
+    write('key,value\n')
+
+    local cursor
+    repeat
+      local page
+      page, cursor = kv.scan({limit = 500, cursor = cursor})
+      for _, pair in ipairs(page) do
+        write(pair.key .. ',' .. pair.value .. '\n')
+      end
+    until cursor == nil
+  end, 'text/csv')
+end)
+
+-- tick once a second until the client goes away or someone posts to /clock/stop
+-- waiting on the subscription paces the ticks without tying up a process like sleeping in a shell would
+-- try it with `curl -N localhost:3333/clock`
+app.get('/clock', function(ctx)
+  ctx.sse(function(send)
+    local stop = pubsub.subscribe('clock:stop')
+    local tick = 0
+    while true do
+      local _, err = stop.receive(1)
+      if err ~= 'timeout' then
+        break
+      end
+
+      tick = tick + 1
+      send({time = os.time()}, {event = 'tick', id = tick})
+    end
+    stop.close()
+  end)
+end)
+
+app.post('/clock/stop', function(ctx)
+  return {stopped = pubsub.publish('clock:stop', 'stop')}
+end)
@@ -0,0 +1,26 @@
+local app = require('heart.v1')
+
+-- describe the files uploaded under the multipart key 'files'
+app.post('/describe', function(ctx)
+  local described = {}
+  for _, file in ipairs(ctx.files('files')) do
+    table.insert(described, {filename = file.filename, size = file.size, contentType = file.contentType})
+  end
+
+  return {files = described}
+end)
+
+-- save the file uploaded under the multipart key 'file' into /tmp
+app.post('/save', function(ctx)
+  local file = ctx.files('file')[1]
+  if file == nil then
+    return {error = 'missing multipart key \'file\''}, 400
+  end
+
+  local saved, err = ctx.saveFile('file', '/tmp/' .. file.filename:gsub('[/\\]', '_'))
+  if not saved then
+    return {error = err}, 500
+  end
+
+  return '', 201
+end)
@@ -0,0 +1,27 @@
+local app = require('heart.v1')
+
+-- echo every message back to the client until it hangs up
+-- try it with `websocat ws://localhost:3333/echo/me`
+app.websocket('/echo/:name', function(ws)
+  local name = ws.ctx.pathParam('name')
+  ws.send('hello ' .. name)
+
+  while true do
+    local message, kind = ws.receive()
+    if message == nil then
+      return
+    end
+
+    if message == 'bye' then
+      ws.close(1000, 'see you later ' .. name)
+      return
+    end
+
+    ws.send(message, kind)
+  end
+end)
+
+-- plain requests to the same path are still handled by a regular route
+app.get('/echo/:name', function(ctx)
+  return 'connect with a websocket client to chat'
+end)
@@ -0,0 +1,150 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// how many writes Load keeps in flight while restoring a backup
+const maxPendingWrites = 256
+
+// the encoding of an exported pair whose key or value isn't valid UTF-8
+// JSON strings can only hold text so the bytes would be mangled otherwise
+const base64Encoding = "base64"
+
+// exportedPair is a single line of a JSONL export
+type exportedPair struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Encoding  string `json:"encoding,omitempty"`
+	ExpiresAt uint64 `json:"expiresAt,omitempty"`
+}
+
+// newExportedPair keeps the key and value as text when it can so the export stays readable
+func newExportedPair(key []byte, value []byte, expiresAt uint64) exportedPair {
+	if utf8.Valid(key) && utf8.Valid(value) {
+		return exportedPair{Key: string(key), Value: string(value), ExpiresAt: expiresAt}
+	}
+
+	return exportedPair{
+		Key:       base64.StdEncoding.EncodeToString(key),
+		Value:     base64.StdEncoding.EncodeToString(value),
+		Encoding:  base64Encoding,
+		ExpiresAt: expiresAt,
+	}
+}
+
+// decode the key and value back into the bytes they were exported from
+func (pair exportedPair) decode() ([]byte, []byte, error) {
+	switch pair.Encoding {
+	case "":
+		return []byte(pair.Key), []byte(pair.Value), nil
+	case base64Encoding:
+		key, err := base64.StdEncoding.DecodeString(pair.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		value, err := base64.StdEncoding.DecodeString(pair.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return key, value, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown encoding %q", pair.Encoding)
+	}
+}
+
+// Backup every version of every key newer than since to w in badger's backup format
+// returns the version to pass as since for an incremental backup that picks up where this one left off
+func (kv *KV) Backup(w io.Writer, since uint64) (uint64, error) {
+	return kv.db.Backup(w, since)
+}
+
+// Load a backup made by Backup into the store
+// it should be done while nothing else is writing to the store
+func (kv *KV) Load(r io.Reader) error {
+	return kv.db.Load(r, maxPendingWrites)
+}
+
+// Export the latest value of every key to w as JSON lines like {"key":"k","value":"v","expiresAt":1600000000}
+// expiresAt is a unix timestamp that's left out for keys that never expire
+// pairs that aren't valid UTF-8 have their key and value base64 encoded and "encoding":"base64" set
+func (kv *KV) Export(w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+
+	err := kv.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			err = encoder.Encode(newExportedPair(item.Key(), value, item.ExpiresAt()))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return buffered.Flush()
+}
+
+// Import JSON lines written by Export into the store and get how many pairs were imported
+// pairs that already expired are skipped
+func (kv *KV) Import(r io.Reader) (int, error) {
+	batch := kv.db.NewWriteBatch()
+	defer batch.Cancel()
+
+	count := 0
+	decoder := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var pair exportedPair
+		err := decoder.Decode(&pair)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, fmt.Errorf("failed to decode pair %d: %s", line, err)
+		}
+
+		key, value, err := pair.decode()
+		if err != nil {
+			return count, fmt.Errorf("failed to decode pair %d: %s", line, err)
+		}
+
+		entry := badger.NewEntry(key, value)
+		if pair.ExpiresAt != 0 {
+			if !time.Unix(int64(pair.ExpiresAt), 0).After(time.Now()) {
+				continue
+			}
+			entry.ExpiresAt = pair.ExpiresAt
+		}
+
+		err = batch.SetEntry(entry)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, batch.Flush()
+}
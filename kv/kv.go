@@ -1,21 +1,26 @@
 package kv
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/rs/zerolog/log"
-	"github.com/sosodev/heart/config"
+	"github.com/valyala/fastrand"
 )
 
 // KV store for both in-memory and on-disk usage
 type KV struct {
-	medium      string
-	db          *badger.DB
-	transaction *badger.Txn
+	name       string
+	db         *badger.DB
+	serialLock *sync.Mutex
+	defaultTTL time.Duration
 }
 
 // Pair you know
@@ -25,10 +30,10 @@ type Pair struct {
 }
 
 var (
-	memoryDB         *badger.DB
-	memorySerialLock sync.Mutex
-	diskDB           *badger.DB
-	diskSerialLock   sync.Mutex
+	// ErrConflict is returned when committing a transaction that read a key another transaction wrote first
+	ErrConflict = badger.ErrConflict
+	// ErrTransactionDone is returned when using a transaction that has already been committed or discarded
+	ErrTransactionDone = errors.New("the transaction has already been committed or discarded")
 )
 
 // LogWrapper for translating badger logs  to zerolog logs
@@ -54,72 +59,23 @@ func (*LogWrapper) Debugf(s string, i ...interface{}) {
 	log.Debug().Msgf(strings.TrimSuffix(s, "\n"), i...)
 }
 
-// GetMemoryStore does what it says on the tin
-func GetMemoryStore() (*KV, error) {
-	var err error
-	if memoryDB == nil {
-		memoryDB, err = badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(&LogWrapper{}))
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	return &KV{
-		medium: "memory",
-		db:     memoryDB,
-	}, nil
+// Size of the store's LSM tree and value log in bytes
+func (kv *KV) Size() (lsm int64, vlog int64) {
+	return kv.db.Size()
 }
 
-// GetDiskStore does what it says on the tin
-func GetDiskStore() (*KV, error) {
-	config := config.NewConfig()
-
-	var err error
-	if diskDB == nil {
-		diskDB, err = badger.Open(badger.DefaultOptions(config.DBPath).WithSyncWrites(config.DBSyncWrites).WithLogger(&LogWrapper{}))
-		if err != nil {
-			return nil, err
-		}
-
-		if !config.DBSyncWrites {
-			syncInterval := time.NewTicker(100 * time.Millisecond)
-			go func() {
-				for {
-					select {
-					case <-syncInterval.C:
-						err = diskDB.Sync()
-						if err != nil {
-							log.Error().Err(err).Msg("Failed to sync database")
-						}
-					}
-				}
-			}()
-		}
-	}
-
-	return &KV{
-		medium: "disk",
-		db:     diskDB,
-	}, nil
-}
+// Get the value for the given key without a transcation or error
+func (kv *KV) Get(key string) (string, error) {
+	value, _, err := kv.GetWithTTL(key)
 
-// CloseStores closes the stores
-func CloseStores() {
-	if diskDB != nil {
-		if err := diskDB.Close(); err != nil {
-			log.Error().Err(err).Msg("Failed to close disk store")
-		}
-	}
-	if memoryDB != nil {
-		if err := memoryDB.Close(); err != nil {
-			log.Error().Err(err).Msg("Failed to close memory store")
-		}
-	}
+	return value, err
 }
 
-// Get the value for the given key without a transcation or error
-func (kv *KV) Get(key string) (string, error) {
+// GetWithTTL gets the value for the given key and how long it has left to live without a transaction or error
+// the TTL is 0 for keys that never expire
+func (kv *KV) GetWithTTL(key string) (string, time.Duration, error) {
 	var value string
+	var ttl time.Duration
 	err := kv.db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(key))
 		if err != nil {
@@ -138,10 +94,22 @@ func (kv *KV) Get(key string) (string, error) {
 			return fmt.Errorf("failed to retrieve item value: %s", err)
 		}
 
+		ttl = remainingTTL(item)
+
 		return nil
 	})
 
-	return value, err
+	return value, ttl, err
+}
+
+// how long the item has left before it expires or 0 if it never does
+func remainingTTL(item *badger.Item) time.Duration {
+	expiresAt := item.ExpiresAt()
+	if expiresAt == 0 {
+		return 0
+	}
+
+	return time.Until(time.Unix(int64(expiresAt), 0))
 }
 
 // ListKeys with the given prefix up to the limit specified or error
@@ -212,91 +180,275 @@ func (kv *KV) ListPairs(prefix string, limit int) ([]Pair, error) {
 	return results, nil
 }
 
-// StartTransaction or error
-func (kv *KV) StartTransaction() error {
-	kv.transaction = kv.db.NewTransaction(true)
+// how many times an optimistic update is retried when another transaction wrote the same key first
+const maxConflictRetries = 100
 
-	return nil
+// the longest Backoff waits before a retry
+const maxConflictBackoff = 10 * time.Millisecond
+
+// Backoff before retrying a transaction that conflicted
+// it waits for a random and growing amount of time so transactions on hot keys don't livelock
+func Backoff(attempt int) {
+	backoff := 50 * time.Microsecond
+	for i := 0; i < attempt && backoff < maxConflictBackoff; i++ {
+		backoff *= 2
+	}
+
+	time.Sleep(time.Duration(fastrand.Uint32n(uint32(backoff))))
 }
 
-// EndTransaction or error
-func (kv *KV) EndTransaction() error {
-	defer kv.transaction.Discard()
+// Retry fn up to attempts times for as long as it fails with ErrConflict
+// any other error, or success, is returned right away
+func Retry(attempts int, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		err = fn()
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
 
-	err := kv.transaction.Commit()
-	if err != nil {
-		return err
+		Backoff(attempt)
 	}
 
-	return nil
+	return fmt.Errorf("gave up after %d attempts: %w", attempts, err)
+}
+
+// update runs fn in an optimistic transaction and retries it when it conflicts with another one
+func (kv *KV) update(fn func(txn *badger.Txn) error) error {
+	return Retry(maxConflictRetries, func() error {
+		return kv.db.Update(fn)
+	})
 }
 
-// StartSerialTransaction or error
-func (kv *KV) StartSerialTransaction() error {
-	if kv.medium == "disk" {
-		diskSerialLock.Lock()
-	} else if kv.medium == "memory" {
-		memorySerialLock.Lock()
+// newEntry for the KV pair that expires after the store's default TTL if it has one
+func (kv *KV) newEntry(key, value string) *badger.Entry {
+	entry := badger.NewEntry([]byte(key), []byte(value))
+	if kv.defaultTTL > 0 {
+		entry = withTTL(entry, kv.defaultTTL)
 	}
 
-	kv.transaction = kv.db.NewTransaction(true)
-	return nil
+	return entry
 }
 
-// EndSerialTransaction or error
-func (kv *KV) EndSerialTransaction() error {
-	defer kv.transaction.Discard()
-	if kv.medium == "disk" {
-		defer diskSerialLock.Unlock()
-	} else if kv.medium == "memory" {
-		defer memorySerialLock.Unlock()
+// withTTL sets the entry to expire once the TTL has passed
+// badger tracks expiry to the second and its WithTTL truncates which can expire a short TTL as soon as it's written
+// so the expiry is rounded up to the next second instead
+func withTTL(entry *badger.Entry, ttl time.Duration) *badger.Entry {
+	expiresAt := time.Now().Add(ttl)
+	seconds := expiresAt.Unix()
+	if expiresAt.After(time.Unix(seconds, 0)) {
+		seconds++
 	}
+	entry.ExpiresAt = uint64(seconds)
 
-	err := kv.transaction.Commit()
-	if err != nil {
-		return err
-	}
+	return entry
+}
 
-	return nil
+// Increment the integer stored at the key by delta and get the new value or error
+// missing keys start at 0 and keys that expire keep their expiry
+func (kv *KV) Increment(key string, delta int64) (int64, error) {
+	var result int64
+	err := kv.update(func(txn *badger.Txn) error {
+		current := int64(0)
+		expiresAt := uint64(0)
+
+		item, err := txn.Get([]byte(key))
+		if err != nil && err != badger.ErrKeyNotFound {
+			return fmt.Errorf("failed to retrieve item: %s", err)
+		}
+		if err == nil {
+			expiresAt = item.ExpiresAt()
+			err = item.Value(func(val []byte) error {
+				current, err = strconv.ParseInt(string(val), 10, 64)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("value at %s isn't an integer: %s", key, err)
+			}
+		}
+
+		result = current + delta
+		entry := kv.newEntry(key, strconv.FormatInt(result, 10))
+		if expiresAt != 0 {
+			entry.ExpiresAt = expiresAt
+		}
+
+		return txn.SetEntry(entry)
+	})
+
+	return result, err
 }
 
-// TransactionGet the value for the given key or error as part of a transaction
-func (kv *KV) TransactionGet(key string) (string, error) {
-	var value string
+// CompareAndSwap sets the key to the new value only if it currently holds the expected value
+// an expected value of "" matches a missing key like Get does
+// returns whether the swap happened or error
+func (kv *KV) CompareAndSwap(key, expected, new string) (bool, error) {
+	swapped := false
+	err := kv.update(func(txn *badger.Txn) error {
+		swapped = false
+		current := ""
 
-	item, err := kv.transaction.Get([]byte(key))
-	if err != nil {
-		if err == badger.ErrKeyNotFound {
-			return "", nil
+		item, err := txn.Get([]byte(key))
+		if err != nil && err != badger.ErrKeyNotFound {
+			return fmt.Errorf("failed to retrieve item: %s", err)
+		}
+		if err == nil {
+			err = item.Value(func(val []byte) error {
+				current = string(val)
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to retrieve item value: %s", err)
+			}
 		}
 
-		return "", fmt.Errorf("failed to retrieve item: %s", err)
-	}
+		if current != expected {
+			return nil
+		}
 
-	err = item.Value(func(val []byte) error {
-		value = string(val)
-		return nil
+		swapped = true
+		return txn.SetEntry(kv.newEntry(key, new))
 	})
 
-	return value, err
+	return swapped, err
+}
+
+// ScanOptions for Scan
+// Start and Stop narrow the scan down to a range of keys within the prefix
+// Start is inclusive and Stop is exclusive no matter which direction the scan goes
+// Cursor is the cursor returned by the previous page and a Limit of 0 scans everything
+type ScanOptions struct {
+	Prefix  string
+	Start   string
+	Stop    string
+	Reverse bool
+	Limit   int
+	Cursor  string
 }
 
-// TransactionSet the KV pair or error as part of a transaction
-func (kv *KV) TransactionSet(key, value string) error {
-	err := kv.transaction.Set([]byte(key), []byte(value))
+// Scan the pairs matching the options in key order, or reverse key order, up to the limit or error
+// returns a cursor for the next page or "" if there isn't one
+func (kv *KV) Scan(options ScanOptions) ([]Pair, string, error) {
+	results := make([]Pair, 0)
+
+	// the cursor is just the last key of the previous page
+	after := []byte(nil)
+	if options.Cursor != "" {
+		var err error
+		after, err = base64.RawURLEncoding.DecodeString(options.Cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid cursor: %s", err)
+		}
+	}
+
+	prefix := []byte(options.Prefix)
+	start := []byte(options.Start)
+	stop := []byte(options.Stop)
+
+	seek := prefix
+	if options.Reverse {
+		// seek to the first key past the prefix, or the very end when nothing sorts past it
+		seek = prefixEnd(prefix)
+		if len(start) > 0 && (seek == nil || bytes.Compare(start, seek) < 0) {
+			seek = start
+		}
+	} else if bytes.Compare(start, seek) > 0 {
+		seek = start
+	}
+	if after != nil {
+		seek = after
+	}
+
+	cursor := ""
+	err := kv.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = options.Reverse
+
+		// a reverse scan can land on the key right past the prefix which the iterator's prefix would treat as the end
+		// so it checks the prefix itself
+		if !options.Reverse {
+			opts.Prefix = prefix
+		}
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(seek); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.Key()
+
+			if after != nil && bytes.Equal(key, after) {
+				continue
+			}
+
+			if !bytes.HasPrefix(key, prefix) {
+				if options.Reverse && bytes.Compare(key, prefix) > 0 {
+					continue
+				}
+				break
+			}
+
+			if len(stop) > 0 {
+				comparison := bytes.Compare(key, stop)
+				if (!options.Reverse && comparison >= 0) || (options.Reverse && comparison <= 0) {
+					break
+				}
+			}
+
+			// there's at least one more pair so the next page has something in it
+			if options.Limit > 0 && len(results) >= options.Limit {
+				cursor = base64.RawURLEncoding.EncodeToString([]byte(results[len(results)-1].Key))
+				break
+			}
+
+			value := ""
+			err := item.Value(func(val []byte) error {
+				value = string(val)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			results = append(results, Pair{
+				Key:   string(key),
+				Value: value,
+			})
+		}
+
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
-	return nil
+	return results, cursor, nil
 }
 
-// TransactionDelete the given key or error as part of a transaction
-func (kv *KV) TransactionDelete(key string) error {
-	err := kv.transaction.Delete([]byte(key))
-	if err != nil {
-		return err
+// the smallest key that sorts after every key with the prefix or nil if there isn't one
+// like when the prefix is empty or all 0xFF
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
 	}
 
 	return nil
 }
+
+// StartTransaction gets you a new *Transaction or error
+func (kv *KV) StartTransaction() (*Transaction, error) {
+	return &Transaction{txn: kv.db.NewTransaction(true), defaultTTL: kv.defaultTTL}, nil
+}
+
+// StartSerialTransaction gets you a new *Transaction or error
+// other serial transactions on the same store wait until it's committed or discarded
+// so starting one while another is still open on the same goroutine deadlocks
+func (kv *KV) StartSerialTransaction() (*Transaction, error) {
+	kv.serialLock.Lock()
+
+	return &Transaction{txn: kv.db.NewTransaction(true), defaultTTL: kv.defaultTTL, unlock: kv.serialLock.Unlock}, nil
+}
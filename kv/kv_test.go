@@ -1,7 +1,17 @@
 package kv_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sosodev/heart/kv"
 )
@@ -21,17 +31,17 @@ func TestKV(t *testing.T) {
 		t.Error("initial value should be empty")
 	}
 
-	err = kv.StartTransaction()
+	txn, err := kv.StartTransaction()
 	if err != nil {
 		t.Fatalf("failed to start transaction: %s", err)
 	}
 
-	err = kv.TransactionSet("test-key", "Hello, world!")
+	err = txn.Set("test-key", "Hello, world!")
 	if err != nil {
 		t.Fatalf("failed to set key: %s", err)
 	}
 
-	value, err = kv.TransactionGet("test-key")
+	value, err = txn.Get("test-key")
 	if err != nil {
 		t.Fatalf("failed to get key: %s", err)
 	}
@@ -40,7 +50,7 @@ func TestKV(t *testing.T) {
 		t.Error("incorrect transaction value after set")
 	}
 
-	err = kv.EndTransaction()
+	err = txn.Commit()
 	if err != nil {
 		t.Fatalf("failed to end transaction: %s", err)
 	}
@@ -54,3 +64,849 @@ func TestKV(t *testing.T) {
 		t.Errorf("incorrect read value outside of transaction, expected %s got %s", "Hello, world!", value)
 	}
 }
+
+func TestTTL(t *testing.T) {
+	store, err := kv.GetMemoryStore()
+	if err != nil {
+		t.Fatalf("failed to get memory store: %s", err)
+	}
+
+	txn, err := store.StartTransaction()
+	if err != nil {
+		t.Fatalf("failed to start transaction: %s", err)
+	}
+
+	err = txn.Set("permanent-key", "forever")
+	if err != nil {
+		t.Fatalf("failed to set key: %s", err)
+	}
+
+	err = txn.SetWithTTL("hour-key", "for now", time.Hour)
+	if err != nil {
+		t.Fatalf("failed to set key with TTL: %s", err)
+	}
+
+	err = txn.SetWithTTL("second-key", "gone soon", time.Second)
+	if err != nil {
+		t.Fatalf("failed to set key with TTL: %s", err)
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		t.Fatalf("failed to end transaction: %s", err)
+	}
+
+	value, ttl, err := store.GetWithTTL("permanent-key")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err)
+	}
+
+	if value != "forever" || ttl != 0 {
+		t.Errorf("permanent key should have no TTL, got %q with %s", value, ttl)
+	}
+
+	value, ttl, err = store.GetWithTTL("hour-key")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err)
+	}
+
+	if value != "for now" || ttl <= 59*time.Minute || ttl > time.Hour+time.Second {
+		t.Errorf("key should have about an hour to live, got %q with %s", value, ttl)
+	}
+
+	time.Sleep(2 * time.Second)
+
+	value, err = store.Get("second-key")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err)
+	}
+
+	if value != "" {
+		t.Errorf("key should have expired, got %q", value)
+	}
+}
+
+func TestShortTTL(t *testing.T) {
+	store, err := kv.GetMemoryStore()
+	if err != nil {
+		t.Fatalf("failed to get memory store: %s", err)
+	}
+
+	txn, err := store.StartTransaction()
+	if err != nil {
+		t.Fatalf("failed to start transaction: %s", err)
+	}
+
+	err = txn.SetWithTTL("blink-key", "still here", 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to set key with TTL: %s", err)
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		t.Fatalf("failed to end transaction: %s", err)
+	}
+
+	// badger only tracks expiry to the second so a TTL under one mustn't expire the key right away
+	value, ttl, err := store.GetWithTTL("blink-key")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err)
+	}
+
+	if value != "still here" || ttl <= 0 || ttl > time.Second {
+		t.Errorf("key should live for up to a second, got %q with %s", value, ttl)
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	store, err := kv.GetMemoryStore()
+	if err != nil {
+		t.Fatalf("failed to get memory store: %s", err)
+	}
+
+	var wait sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 50; j++ {
+				_, err := store.Increment("counter", 2)
+				if err != nil {
+					t.Errorf("failed to increment: %s", err)
+				}
+			}
+		}()
+	}
+	wait.Wait()
+
+	value, err := store.Increment("counter", -600)
+	if err != nil {
+		t.Fatalf("failed to increment: %s", err)
+	}
+
+	if value != 1000 {
+		t.Errorf("incorrect counter value, expected 1000 got %d", value)
+	}
+
+	txn, err := store.StartTransaction()
+	if err != nil {
+		t.Fatalf("failed to start transaction: %s", err)
+	}
+
+	err = txn.Set("not-a-counter", "hello")
+	if err != nil {
+		t.Fatalf("failed to set key: %s", err)
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		t.Fatalf("failed to end transaction: %s", err)
+	}
+
+	_, err = store.Increment("not-a-counter", 1)
+	if err == nil {
+		t.Error("incrementing a value that isn't an integer should fail")
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	store, err := kv.GetMemoryStore()
+	if err != nil {
+		t.Fatalf("failed to get memory store: %s", err)
+	}
+
+	swapped, err := store.CompareAndSwap("state", "", "pending")
+	if err != nil {
+		t.Fatalf("failed to compare and swap: %s", err)
+	}
+
+	if !swapped {
+		t.Error("missing key should match an empty expected value")
+	}
+
+	swapped, err = store.CompareAndSwap("state", "done", "failed")
+	if err != nil {
+		t.Fatalf("failed to compare and swap: %s", err)
+	}
+
+	if swapped {
+		t.Error("swapped even though the expected value didn't match")
+	}
+
+	// only one of the racing swaps from pending can win
+	var wins int32
+	var wait sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			swapped, err := store.CompareAndSwap("state", "pending", "done")
+			if err != nil {
+				t.Errorf("failed to compare and swap: %s", err)
+			}
+			if swapped {
+				atomic.AddInt32(&wins, 1)
+			}
+		}()
+	}
+	wait.Wait()
+
+	if wins != 1 {
+		t.Errorf("expected exactly one swap to win, got %d", wins)
+	}
+
+	value, err := store.Get("state")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err)
+	}
+
+	if value != "done" {
+		t.Errorf("incorrect value after swaps, expected done got %s", value)
+	}
+}
+
+func TestDiscardSerialTransaction(t *testing.T) {
+	store, err := kv.GetMemoryStore()
+	if err != nil {
+		t.Fatalf("failed to get memory store: %s", err)
+	}
+
+	txn, err := store.StartSerialTransaction()
+	if err != nil {
+		t.Fatalf("failed to start serial transaction: %s", err)
+	}
+
+	err = txn.Set("discarded-key", "never written")
+	if err != nil {
+		t.Fatalf("failed to set key: %s", err)
+	}
+
+	txn.Discard()
+
+	// the serial lock has to be released or this deadlocks
+	txn, err = store.StartSerialTransaction()
+	if err != nil {
+		t.Fatalf("failed to start serial transaction after discard: %s", err)
+	}
+
+	value, err := txn.Get("discarded-key")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err)
+	}
+
+	if value != "" {
+		t.Errorf("discarded write should not be visible, got %q", value)
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		t.Fatalf("failed to commit serial transaction: %s", err)
+	}
+
+	err = txn.Set("discarded-key", "no transaction")
+	if err != kv.ErrTransactionDone {
+		t.Errorf("expected ErrTransactionDone after the transaction was committed, got %v", err)
+	}
+}
+
+func TestOverlappingTransactions(t *testing.T) {
+	memoryStore, err := kv.GetMemoryStore()
+	if err != nil {
+		t.Fatalf("failed to get memory store: %s", err)
+	}
+
+	os.Setenv("DB_PATH", t.TempDir())
+	defer os.Unsetenv("DB_PATH")
+
+	diskStore, err := kv.GetDiskStore()
+	if err != nil {
+		t.Fatalf("failed to get disk store: %s", err)
+	}
+	defer kv.CloseStores()
+
+	outer, err := memoryStore.StartTransaction()
+	if err != nil {
+		t.Fatalf("failed to start transaction: %s", err)
+	}
+
+	inner, err := memoryStore.StartTransaction()
+	if err != nil {
+		t.Fatalf("failed to start nested transaction: %s", err)
+	}
+
+	disk, err := diskStore.StartSerialTransaction()
+	if err != nil {
+		t.Fatalf("failed to start disk transaction: %s", err)
+	}
+
+	for key, txn := range map[string]*kv.Transaction{"outer-key": outer, "inner-key": inner, "disk-key": disk} {
+		err = txn.Set(key, key)
+		if err != nil {
+			t.Fatalf("failed to set %s: %s", key, err)
+		}
+	}
+
+	// the nested transaction can't see the outer one's uncommitted write
+	value, err := inner.Get("outer-key")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err)
+	}
+
+	if value != "" {
+		t.Errorf("uncommitted write leaked into another transaction, got %q", value)
+	}
+
+	err = inner.Commit()
+	if err != nil {
+		t.Fatalf("failed to commit nested transaction: %s", err)
+	}
+
+	outer.Discard()
+
+	err = disk.Commit()
+	if err != nil {
+		t.Fatalf("failed to commit disk transaction: %s", err)
+	}
+
+	expected := map[*kv.KV]map[string]string{
+		memoryStore: {"inner-key": "inner-key", "outer-key": ""},
+		diskStore:   {"disk-key": "disk-key"},
+	}
+	for store, pairs := range expected {
+		for key, expectedValue := range pairs {
+			value, err := store.Get(key)
+			if err != nil {
+				t.Fatalf("failed to get %s: %s", key, err)
+			}
+
+			if value != expectedValue {
+				t.Errorf("incorrect value for %s, expected %q got %q", key, expectedValue, value)
+			}
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	attempts := 0
+	err := kv.Retry(5, func() error {
+		attempts++
+		if attempts < 3 {
+			return kv.ErrConflict
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("retry should succeed once the conflicts stop: %s", err)
+	}
+
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+
+	attempts = 0
+	err = kv.Retry(4, func() error {
+		attempts++
+		return kv.ErrConflict
+	})
+	if !errors.Is(err, kv.ErrConflict) || attempts != 4 {
+		t.Errorf("expected ErrConflict after 4 attempts, got %v after %d", err, attempts)
+	}
+
+	attempts = 0
+	other := errors.New("not a conflict")
+	err = kv.Retry(4, func() error {
+		attempts++
+		return other
+	})
+	if err != other || attempts != 1 {
+		t.Errorf("errors other than conflicts should not be retried, got %v after %d", err, attempts)
+	}
+}
+
+func TestScan(t *testing.T) {
+	store, err := kv.GetMemoryStore()
+	if err != nil {
+		t.Fatalf("failed to get memory store: %s", err)
+	}
+
+	txn, err := store.StartTransaction()
+	if err != nil {
+		t.Fatalf("failed to start transaction: %s", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		err = txn.Set(fmt.Sprintf("scan_%03d", i), strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("failed to set key: %s", err)
+		}
+	}
+
+	for _, key := range []string{"scam", "scan", "scao"} {
+		err = txn.Set(key, key)
+		if err != nil {
+			t.Fatalf("failed to set key: %s", err)
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		t.Fatalf("failed to commit transaction: %s", err)
+	}
+
+	// collect every page of the scan
+	scanAll := func(options kv.ScanOptions) []string {
+		keys := make([]string, 0)
+		for pages := 0; pages < 100; pages++ {
+			results, cursor, err := store.Scan(options)
+			if err != nil {
+				t.Fatalf("failed to scan: %s", err)
+			}
+
+			for _, result := range results {
+				keys = append(keys, result.Key)
+			}
+
+			if cursor == "" {
+				return keys
+			}
+			options.Cursor = cursor
+		}
+
+		t.Fatal("scan never ran out of pages")
+		return nil
+	}
+
+	keys := scanAll(kv.ScanOptions{Prefix: "scan_", Limit: 30})
+	if len(keys) != 100 || keys[0] != "scan_000" || keys[99] != "scan_099" {
+		t.Errorf("forward scan should page through all 100 keys in order, got %d: %v", len(keys), keys)
+	}
+
+	keys = scanAll(kv.ScanOptions{Prefix: "scan_", Limit: 7, Reverse: true})
+	if len(keys) != 100 || keys[0] != "scan_099" || keys[99] != "scan_000" {
+		t.Errorf("reverse scan should page through all 100 keys in reverse order, got %d: %v", len(keys), keys)
+	}
+
+	keys = scanAll(kv.ScanOptions{Prefix: "scan_", Start: "scan_010", Stop: "scan_020", Limit: 4})
+	if strings.Join(keys, ",") != "scan_010,scan_011,scan_012,scan_013,scan_014,scan_015,scan_016,scan_017,scan_018,scan_019" {
+		t.Errorf("incorrect range scan: %v", keys)
+	}
+
+	keys = scanAll(kv.ScanOptions{Prefix: "scan_", Start: "scan_020", Stop: "scan_015", Reverse: true})
+	if strings.Join(keys, ",") != "scan_020,scan_019,scan_018,scan_017,scan_016" {
+		t.Errorf("incorrect reverse range scan: %v", keys)
+	}
+
+	results, cursor, err := store.Scan(kv.ScanOptions{Prefix: "scan_", Limit: 100})
+	if err != nil {
+		t.Fatalf("failed to scan: %s", err)
+	}
+
+	if len(results) != 100 || cursor != "" {
+		t.Errorf("exactly filling the limit shouldn't return a cursor, got %d results and cursor %q", len(results), cursor)
+	}
+
+	_, _, err = store.Scan(kv.ScanOptions{Cursor: "not a cursor!"})
+	if err == nil {
+		t.Error("scanning with an invalid cursor should fail")
+	}
+}
+
+func TestScanReverseHighBytes(t *testing.T) {
+	store, err := kv.Open("scan-high-bytes", kv.StoreOptions{Medium: "memory"})
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer kv.CloseStores()
+
+	txn, err := store.StartTransaction()
+	if err != nil {
+		t.Fatalf("failed to start transaction: %s", err)
+	}
+
+	// hc is the first key past the hb prefix so a reverse scan of hb seeks right onto it
+	for _, key := range []string{"ha", "hb\x00", "hb\x7f", "hb\xff", "hb\xff\xff", "hb\xff\xffz", "hc", "\xff", "\xff\x01"} {
+		err = txn.Set(key, key)
+		if err != nil {
+			t.Fatalf("failed to set key: %s", err)
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		t.Fatalf("failed to commit transaction: %s", err)
+	}
+
+	for _, test := range []struct {
+		prefix   string
+		limit    int
+		expected []string
+	}{
+		{"hb", 0, []string{"hb\xff\xffz", "hb\xff\xff", "hb\xff", "hb\x7f", "hb\x00"}},
+		{"hb", 2, []string{"hb\xff\xffz", "hb\xff\xff", "hb\xff", "hb\x7f", "hb\x00"}},
+		{"hb\xff", 0, []string{"hb\xff\xffz", "hb\xff\xff", "hb\xff"}},
+		{"\xff", 0, []string{"\xff\x01", "\xff"}},
+	} {
+		keys := make([]string, 0)
+		options := kv.ScanOptions{Prefix: test.prefix, Limit: test.limit, Reverse: true}
+		for {
+			results, cursor, err := store.Scan(options)
+			if err != nil {
+				t.Fatalf("failed to scan: %s", err)
+			}
+
+			for _, result := range results {
+				keys = append(keys, result.Key)
+			}
+
+			if cursor == "" {
+				break
+			}
+			options.Cursor = cursor
+		}
+
+		if fmt.Sprintf("%q", keys) != fmt.Sprintf("%q", test.expected) {
+			t.Errorf("reverse scan of %q with limit %d expected %q got %q", test.prefix, test.limit, test.expected, keys)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	sessions, err := kv.Open("sessions", kv.StoreOptions{Medium: "memory", TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to open sessions store: %s", err)
+	}
+
+	buckets, err := kv.Open("buckets", kv.StoreOptions{Medium: "disk", Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("failed to open buckets store: %s", err)
+	}
+	defer kv.CloseStores()
+
+	for store, value := range map[*kv.KV]string{sessions: "session", buckets: "bucket"} {
+		txn, err := store.StartTransaction()
+		if err != nil {
+			t.Fatalf("failed to start transaction: %s", err)
+		}
+
+		err = txn.Set("shared_key", value)
+		if err != nil {
+			t.Fatalf("failed to set key: %s", err)
+		}
+
+		err = txn.Commit()
+		if err != nil {
+			t.Fatalf("failed to commit transaction: %s", err)
+		}
+	}
+
+	value, ttl, err := sessions.GetWithTTL("shared_key")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err)
+	}
+
+	if value != "session" || ttl <= 59*time.Minute {
+		t.Errorf("sessions store should keep its own value with its default TTL, got %q with %s", value, ttl)
+	}
+
+	value, ttl, err = buckets.GetWithTTL("shared_key")
+	if err != nil {
+		t.Fatalf("failed to get key: %s", err)
+	}
+
+	if value != "bucket" || ttl != 0 {
+		t.Errorf("buckets store should keep its own value without a TTL, got %q with %s", value, ttl)
+	}
+
+	reopened, err := kv.Open("sessions", kv.StoreOptions{Medium: "memory", TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to reopen sessions store: %s", err)
+	}
+
+	if reopened != sessions {
+		t.Error("opening an open store should get the same store")
+	}
+
+	_, err = kv.Open("sessions", kv.StoreOptions{Medium: "disk"})
+	if err == nil {
+		t.Error("opening an open store on another medium should fail")
+	}
+
+	_, err = kv.Open("sessions", kv.StoreOptions{Medium: "memory"})
+	if err == nil {
+		t.Error("opening an open store with another TTL should fail")
+	}
+
+	memory, err := kv.GetMemoryStore()
+	if err != nil {
+		t.Fatalf("failed to get memory store: %s", err)
+	}
+
+	builtin, err := kv.Open("memory", kv.StoreOptions{Medium: "memory", SyncWrites: true})
+	if err != nil || builtin != memory {
+		t.Errorf("opening the memory store with its own options should get it: %v", err)
+	}
+
+	_, err = kv.Open("memory", kv.StoreOptions{Medium: "memory", TTL: time.Minute})
+	if err == nil {
+		t.Error("opening the memory store with a TTL should fail instead of ignoring it")
+	}
+
+	for _, name := range []string{"", "../escape", "a/b", "dots.in.name", "spaced name"} {
+		_, err = kv.Open(name, kv.StoreOptions{Medium: "memory"})
+		if err == nil {
+			t.Errorf("opening a store named %q should fail", name)
+		}
+	}
+
+	_, err = kv.Open("cache", kv.StoreOptions{Medium: "tape"})
+	if err == nil {
+		t.Error("opening a store on an unknown medium should fail")
+	}
+
+	if _, ok := kv.Stores()["buckets"]; !ok {
+		t.Error("open stores should include buckets")
+	}
+}
+
+func TestBackupAndExport(t *testing.T) {
+	source, err := kv.Open("backup-source", kv.StoreOptions{Medium: "memory"})
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer kv.CloseStores()
+
+	txn, err := source.StartTransaction()
+	if err != nil {
+		t.Fatalf("failed to start transaction: %s", err)
+	}
+
+	pairs := map[string]string{"a": "1", "b": "two", "c": `{"json": "value"}`}
+	for key, value := range pairs {
+		err = txn.Set(key, value)
+		if err != nil {
+			t.Fatalf("failed to set key: %s", err)
+		}
+	}
+
+	err = txn.SetWithTTL("expiring", "soon", time.Hour)
+	if err != nil {
+		t.Fatalf("failed to set key with TTL: %s", err)
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		t.Fatalf("failed to commit transaction: %s", err)
+	}
+	pairs["expiring"] = "soon"
+
+	backup := new(bytes.Buffer)
+	_, err = source.Backup(backup, 0)
+	if err != nil {
+		t.Fatalf("failed to back up store: %s", err)
+	}
+
+	export := new(bytes.Buffer)
+	err = source.Export(export)
+	if err != nil {
+		t.Fatalf("failed to export store: %s", err)
+	}
+
+	if lines := strings.Count(export.String(), "\n"); lines != len(pairs) {
+		t.Errorf("expected %d exported lines, got %d:\n%s", len(pairs), lines, export.String())
+	}
+
+	restored, err := kv.Open("backup-restored", kv.StoreOptions{Medium: "memory"})
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	err = restored.Load(backup)
+	if err != nil {
+		t.Fatalf("failed to load backup: %s", err)
+	}
+
+	imported, err := kv.Open("backup-imported", kv.StoreOptions{Medium: "memory"})
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	count, err := imported.Import(export)
+	if err != nil {
+		t.Fatalf("failed to import export: %s", err)
+	}
+
+	if count != len(pairs) {
+		t.Errorf("expected %d imported pairs, got %d", len(pairs), count)
+	}
+
+	for _, store := range []*kv.KV{restored, imported} {
+		for key, expected := range pairs {
+			value, ttl, err := store.GetWithTTL(key)
+			if err != nil {
+				t.Fatalf("failed to get key: %s", err)
+			}
+
+			if value != expected {
+				t.Errorf("incorrect value for %s, expected %q got %q", key, expected, value)
+			}
+
+			if (key == "expiring") != (ttl > 0) {
+				t.Errorf("only the expiring key should have a TTL, %s has %s", key, ttl)
+			}
+		}
+	}
+
+	_, err = imported.Import(strings.NewReader(`{"key": "expired", "value": "gone", "expiresAt": 1}` + "\nnot json\n"))
+	if err == nil {
+		t.Error("importing a line that isn't JSON should fail")
+	}
+}
+
+func TestExportBinary(t *testing.T) {
+	source, err := kv.Open("export-binary-source", kv.StoreOptions{Medium: "memory"})
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer kv.CloseStores()
+
+	// invalid UTF-8 in the key, the value and both
+	pairs := map[string]string{
+		"text":              "plain",
+		"binary":            "\xff\xfe\x00\x80",
+		"\xc3\x28-key":      "value",
+		"\x89PNG\r\n\x1a\n": "\x00\x00\x00\x0dIHDR",
+	}
+
+	txn, err := source.StartTransaction()
+	if err != nil {
+		t.Fatalf("failed to start transaction: %s", err)
+	}
+
+	for key, value := range pairs {
+		err = txn.Set(key, value)
+		if err != nil {
+			t.Fatalf("failed to set key: %s", err)
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		t.Fatalf("failed to commit transaction: %s", err)
+	}
+
+	export := new(bytes.Buffer)
+	err = source.Export(export)
+	if err != nil {
+		t.Fatalf("failed to export store: %s", err)
+	}
+
+	if !strings.Contains(export.String(), `{"key":"text","value":"plain"}`) {
+		t.Errorf("text pairs should be exported as they are:\n%s", export.String())
+	}
+
+	imported, err := kv.Open("export-binary-imported", kv.StoreOptions{Medium: "memory"})
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+
+	count, err := imported.Import(export)
+	if err != nil {
+		t.Fatalf("failed to import export: %s", err)
+	}
+
+	if count != len(pairs) {
+		t.Errorf("expected %d imported pairs, got %d", len(pairs), count)
+	}
+
+	for key, expected := range pairs {
+		value, err := imported.Get(key)
+		if err != nil {
+			t.Fatalf("failed to get %q: %s", key, err)
+		}
+
+		if value != expected {
+			t.Errorf("incorrect value for %q, expected %q got %q", key, expected, value)
+		}
+	}
+
+	_, err = imported.Import(strings.NewReader(`{"key": "a", "value": "b", "encoding": "rot13"}` + "\n"))
+	if err == nil {
+		t.Error("importing a pair with an unknown encoding should fail")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	store, err := kv.Open("subscribed", kv.StoreOptions{Medium: "memory"})
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer kv.CloseStores()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pairs, err := store.Subscribe(ctx, "watched_")
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+
+	write := func(fn func(txn *kv.Transaction) error) {
+		txn, err := store.StartTransaction()
+		if err != nil {
+			t.Fatalf("failed to start transaction: %s", err)
+		}
+
+		err = fn(txn)
+		if err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+
+		err = txn.Commit()
+		if err != nil {
+			t.Fatalf("failed to commit transaction: %s", err)
+		}
+	}
+
+	// the subscription is registered in the background so keep writing until it's seen
+	ready := false
+	for attempt := 0; attempt < 100 && !ready; attempt++ {
+		write(func(txn *kv.Transaction) error { return txn.Set("watched_ready", "yes") })
+
+		select {
+		case <-pairs:
+			ready = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if !ready {
+		t.Fatal("subscription never saw a write")
+	}
+
+	// drain any duplicate ready writes
+	for drained := false; !drained; {
+		select {
+		case <-pairs:
+		case <-time.After(50 * time.Millisecond):
+			drained = true
+		}
+	}
+
+	write(func(txn *kv.Transaction) error { return txn.Set("ignored_key", "nope") })
+	write(func(txn *kv.Transaction) error { return txn.Set("watched_key", "first") })
+	write(func(txn *kv.Transaction) error { return txn.Delete("watched_key") })
+
+	expected := []kv.Pair{{Key: "watched_key", Value: "first"}, {Key: "watched_key", Value: ""}}
+	for _, expectedPair := range expected {
+		select {
+		case pair := <-pairs:
+			if pair != expectedPair {
+				t.Errorf("expected %+v got %+v", expectedPair, pair)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %+v", expectedPair)
+		}
+	}
+
+	cancel()
+	for range pairs {
+	}
+}
@@ -0,0 +1,194 @@
+package kv
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/sosodev/heart/config"
+)
+
+// StoreOptions for Open
+type StoreOptions struct {
+	// Medium is either memory or disk
+	Medium string
+	// Path of the database for disk stores which defaults to DB_PATH.name
+	Path string
+	// SyncWrites makes disk stores sync every write instead of every 100ms
+	SyncWrites bool
+	// TTL every write expires after unless it's given its own
+	TTL time.Duration
+}
+
+// openStore is a store in the registry
+type openStore struct {
+	kv       *KV
+	options  StoreOptions
+	syncStop chan struct{}
+	syncDone chan struct{}
+}
+
+var (
+	stores     = make(map[string]*openStore)
+	storesLock sync.Mutex
+	storeName  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// Open the named store or get it if it's already open
+// every store is its own database so keys in one can't collide with keys in another
+// names can only have letters, digits, _ and - since they're part of the path of disk stores
+// opening a store that's already open with different options is an error, including the built-in memory and disk stores
+func Open(name string, options StoreOptions) (*KV, error) {
+	if !storeName.MatchString(name) {
+		return nil, fmt.Errorf("invalid store name %q, names can only have letters, digits, _ and -", name)
+	}
+
+	var badgerOptions badger.Options
+	switch options.Medium {
+	case "memory":
+		// memory stores don't have a path or anything to sync so they can't conflict on those
+		options.Path = ""
+		options.SyncWrites = false
+		badgerOptions = badger.DefaultOptions("").WithInMemory(true)
+	case "disk":
+		if options.Path == "" {
+			options.Path = config.NewConfig().DBPath + "." + name
+		}
+		badgerOptions = badger.DefaultOptions(options.Path).WithSyncWrites(options.SyncWrites)
+	default:
+		return nil, fmt.Errorf("unknown medium %q for store %s, expected memory or disk", options.Medium, name)
+	}
+
+	storesLock.Lock()
+	defer storesLock.Unlock()
+
+	if open, ok := stores[name]; ok {
+		if open.options != options {
+			return nil, fmt.Errorf("store %s is already open with different options", name)
+		}
+
+		return open.kv, nil
+	}
+
+	db, err := badger.Open(badgerOptions.WithLogger(&LogWrapper{}))
+	if err != nil {
+		return nil, err
+	}
+
+	open := &openStore{
+		kv: &KV{
+			name:       name,
+			db:         db,
+			serialLock: &sync.Mutex{},
+			defaultTTL: options.TTL,
+		},
+		options: options,
+	}
+
+	if options.Medium == "disk" && !options.SyncWrites {
+		open.syncStop = make(chan struct{})
+		open.syncDone = make(chan struct{})
+		go syncDisk(db, open.syncStop, open.syncDone)
+	}
+
+	stores[name] = open
+
+	return open.kv, nil
+}
+
+// GetMemoryStore does what it says on the tin
+func GetMemoryStore() (*KV, error) {
+	return Open("memory", StoreOptions{Medium: "memory"})
+}
+
+// GetDiskStore does what it says on the tin
+func GetDiskStore() (*KV, error) {
+	config := config.NewConfig()
+
+	return Open("disk", StoreOptions{
+		Medium:     "disk",
+		Path:       config.DBPath,
+		SyncWrites: config.DBSyncWrites,
+	})
+}
+
+// Stores that are open by name
+func Stores() map[string]*KV {
+	storesLock.Lock()
+	defer storesLock.Unlock()
+
+	open := make(map[string]*KV, len(stores))
+	for name, store := range stores {
+		open[name] = store.kv
+	}
+
+	return open
+}
+
+// sync the disk store every 100ms until stop is closed
+// writes aren't synced as they happen when sync writes are off
+func syncDisk(db *badger.DB, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	syncInterval := time.NewTicker(100 * time.Millisecond)
+	defer syncInterval.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-syncInterval.C:
+			err := db.Sync()
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to sync database")
+			}
+		}
+	}
+}
+
+// CloseStores closes every open store
+// disk stores get a final sync first so writes since the last tick aren't lost
+func CloseStores() {
+	storesLock.Lock()
+	defer storesLock.Unlock()
+
+	for name, store := range stores {
+		if store.syncStop != nil {
+			close(store.syncStop)
+			<-store.syncDone
+		}
+
+		syncStore(name, store)
+
+		if err := store.kv.db.Close(); err != nil {
+			log.Error().Err(err).Str("store", name).Msg("Failed to close store")
+		}
+
+		delete(stores, name)
+	}
+}
+
+// SyncStores syncs every open disk store without closing it
+// it's for when the stores have to stay open because something may still write to them
+func SyncStores() {
+	storesLock.Lock()
+	defer storesLock.Unlock()
+
+	for name, store := range stores {
+		syncStore(name, store)
+	}
+}
+
+// sync the store to disk if it's a disk store
+func syncStore(name string, store *openStore) {
+	if store.options.Medium != "disk" {
+		return
+	}
+
+	if err := store.kv.db.Sync(); err != nil {
+		log.Error().Err(err).Str("store", name).Msg("Failed to sync store")
+	}
+}
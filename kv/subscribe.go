@@ -0,0 +1,41 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Subscribe to writes to keys with the prefix until ctx is done or the store is closed
+// the channel gets every written pair in commit order and is closed once the subscription ends
+// deleted keys come through with an empty value just like Get returns for them
+// the subscription is registered in the background so writes committed right as it starts can be missed
+func (kv *KV) Subscribe(ctx context.Context, prefix string) (<-chan Pair, error) {
+	if kv.db.IsClosed() {
+		return nil, fmt.Errorf("store %s is closed", kv.name)
+	}
+
+	pairs := make(chan Pair, 64)
+	go func() {
+		defer close(pairs)
+
+		err := kv.db.Subscribe(ctx, func(list *badger.KVList) error {
+			for _, written := range list.GetKv() {
+				select {
+				case pairs <- Pair{Key: string(written.Key), Value: string(written.Value)}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+
+			return nil
+		}, []byte(prefix))
+		if err != nil && err != context.Canceled {
+			log.Error().Err(err).Str("store", kv.name).Str("prefix", prefix).Msg("Subscription failed")
+		}
+	}()
+
+	return pairs, nil
+}
@@ -0,0 +1,101 @@
+package kv
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// Transaction on a single store
+// each one is independent so transactions can overlap, nest or span both mediums
+// it isn't safe to use from more than one goroutine at a time
+type Transaction struct {
+	txn        *badger.Txn
+	defaultTTL time.Duration
+	unlock     func()
+	done       bool
+}
+
+// Get the value for the given key or error
+func (t *Transaction) Get(key string) (string, error) {
+	if t.done {
+		return "", ErrTransactionDone
+	}
+
+	var value string
+
+	item, err := t.txn.Get([]byte(key))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("failed to retrieve item: %s", err)
+	}
+
+	err = item.Value(func(val []byte) error {
+		value = string(val)
+		return nil
+	})
+
+	return value, err
+}
+
+// Set the KV pair or error
+// the pair expires after the store's default TTL if it has one
+func (t *Transaction) Set(key, value string) error {
+	if t.done {
+		return ErrTransactionDone
+	}
+
+	if t.defaultTTL > 0 {
+		return t.SetWithTTL(key, value, t.defaultTTL)
+	}
+
+	return t.txn.Set([]byte(key), []byte(value))
+}
+
+// SetWithTTL sets the KV pair to expire after the TTL or errors
+// badger tracks expiry to the second so the TTL is rounded up to the second too
+func (t *Transaction) SetWithTTL(key, value string, ttl time.Duration) error {
+	if t.done {
+		return ErrTransactionDone
+	}
+
+	return t.txn.SetEntry(withTTL(badger.NewEntry([]byte(key), []byte(value)), ttl))
+}
+
+// Delete the given key or error
+func (t *Transaction) Delete(key string) error {
+	if t.done {
+		return ErrTransactionDone
+	}
+
+	return t.txn.Delete([]byte(key))
+}
+
+// Commit the transaction or error
+// the transaction is over either way
+func (t *Transaction) Commit() error {
+	if t.done {
+		return ErrTransactionDone
+	}
+	defer t.Discard()
+
+	return t.txn.Commit()
+}
+
+// Discard the transaction without committing any of its writes
+// it's safe to call more than once and after Commit
+func (t *Transaction) Discard() {
+	if t.done {
+		return
+	}
+	t.done = true
+
+	t.txn.Discard()
+	if t.unlock != nil {
+		t.unlock()
+	}
+}
@@ -3,20 +3,32 @@
 package las
 
 import (
+	"bufio"
 	"sync"
 	"sync/atomic"
 
 	"github.com/aarzilli/golua/lua"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
 	"github.com/sosodev/heart/kv"
+	"github.com/sosodev/heart/pubsub"
 )
 
 // AssociatedState is the a collection of state that gets associated with *lua.State
+// Stream is a registry reference to the callback a handler streams its response with or 0 if it doesn't
+// and StreamWriter is where that callback writes while it runs
+// Interpreted is true once LuaJIT's compiler has been turned off for the state so instruction hooks always run
 type AssociatedState struct {
-	Ctx         *fiber.Ctx
-	TakeCount   int32
-	MemoryStore *kv.KV
-	DiskStore   *kv.KV
+	Ctx           *fiber.Ctx
+	Websocket     *websocket.Conn
+	Stream        int
+	StreamWriter  *bufio.Writer
+	Interpreted   bool
+	TakeCount     int32
+	MemoryStore   *kv.KV
+	DiskStore     *kv.KV
+	transactions  map[*kv.Transaction]struct{}
+	subscriptions map[*pubsub.Subscription]struct{}
 }
 
 var (
@@ -33,6 +45,42 @@ func (as *AssociatedState) IncrementTakeCount() {
 	atomic.AddInt32(&as.TakeCount, 1)
 }
 
+// TrackTransaction started by the state so it's discarded if the state is freed before it's over
+func (as *AssociatedState) TrackTransaction(txn *kv.Transaction) {
+	if as.transactions == nil {
+		as.transactions = make(map[*kv.Transaction]struct{})
+	}
+
+	as.transactions[txn] = struct{}{}
+}
+
+// UntrackTransaction once it's been committed or discarded
+func (as *AssociatedState) UntrackTransaction(txn *kv.Transaction) {
+	delete(as.transactions, txn)
+}
+
+// TrackSubscription made by the state so it's closed if the state is freed while it's still subscribed
+func (as *AssociatedState) TrackSubscription(subscription *pubsub.Subscription) {
+	if as.subscriptions == nil {
+		as.subscriptions = make(map[*pubsub.Subscription]struct{})
+	}
+
+	as.subscriptions[subscription] = struct{}{}
+}
+
+// UntrackSubscription once it's been closed
+func (as *AssociatedState) UntrackSubscription(subscription *pubsub.Subscription) {
+	delete(as.subscriptions, subscription)
+}
+
+// CloseSubscriptions the state left open so they don't keep buffering messages for a handler that's done with them
+func (as *AssociatedState) CloseSubscriptions() {
+	for subscription := range as.subscriptions {
+		subscription.Close()
+		delete(as.subscriptions, subscription)
+	}
+}
+
 // Get the *AssociatedState for the given *lua.State or a false second return value if not found
 func Get(state *lua.State) (*AssociatedState, bool) {
 	as, ok := asm.Load(state)
@@ -44,7 +92,20 @@ func Get(state *lua.State) (*AssociatedState, bool) {
 }
 
 // Free the *AssociatedState for the given *lua.State
+// transactions it left open, like when a handler was aborted, are discarded so they don't hold serial locks
+// and subscriptions it left open are closed so they don't keep buffering messages
 func Free(state *lua.State) {
+	as, ok := Get(state)
+	if !ok {
+		return
+	}
+
+	for txn := range as.transactions {
+		txn.Discard()
+	}
+
+	as.CloseSubscriptions()
+
 	asm.Delete(state)
 }
 
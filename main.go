@@ -2,6 +2,9 @@ package main
 
 import (
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/aarzilli/golua/lua"
@@ -11,10 +14,20 @@ import (
 	"github.com/rs/zerolog/diode"
 	"github.com/rs/zerolog/log"
 	"github.com/sosodev/heart/build"
+	"github.com/sosodev/heart/cli"
 	"github.com/sosodev/heart/config"
 	"github.com/sosodev/heart/kv"
+	"github.com/sosodev/heart/metrics"
 	"github.com/sosodev/heart/modules"
 	"github.com/sosodev/heart/pool"
+	"github.com/sosodev/heart/pubsub"
+	"github.com/sosodev/heart/reload"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+var (
+	requests        = metrics.NewCounterVec("heart_requests_total", "HTTP requests handled", "method", "route", "status")
+	requestDuration = metrics.NewHistogramVec("heart_request_duration_seconds", "Time spent handling HTTP requests", metrics.DefaultBuckets, "method", "route")
 )
 
 func main() {
@@ -24,12 +37,25 @@ func main() {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
 	}
 
+	// the kv subcommands work on the stores directly instead of starting the server
+	// they log to stderr so exports can be written to stdout
+	if len(os.Args) > 1 && os.Args[1] == "kv" {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		err := cli.KV(os.Args[2:])
+		if err != nil {
+			log.Fatal().Err(err).Msg("kv command failed")
+		}
+		return
+	}
+
 	config := config.NewConfig()
 	zerolog.SetGlobalLevel(config.LogLevel)
 
-	app := fiber.New(fiber.Config{
+	fiberConfig := fiber.Config{
 		DisableStartupMessage: true,
-	})
+		BodyLimit:             config.BodyLimit,
+	}
+	app := fiber.New(fiberConfig)
 
 	// enable pprof profiling if requested
 	if config.Profile {
@@ -37,6 +63,16 @@ func main() {
 		app.Use(pprof.New())
 	}
 
+	// enable the Prometheus metrics endpoint if requested
+	if config.Metrics {
+		log.Info().Msg("Enabling Prometheus metrics on route /metrics")
+		handler := fasthttpadaptor.NewFastHTTPHandler(metrics.Handler())
+		app.Get("/metrics", func(c *fiber.Ctx) error {
+			handler(c.Context())
+			return nil
+		})
+	}
+
 	// logging middleware
 	app.Use(func(c *fiber.Ctx) error {
 		// start timing request
@@ -52,17 +88,24 @@ func main() {
 		}
 
 		responseTime := time.Since(start)
+		if config.Metrics {
+			status := strconv.Itoa(c.Response().StatusCode())
+			requests.WithLabelValues(c.Method(), c.Route().Path, status).Inc()
+			requestDuration.WithLabelValues(c.Method(), c.Route().Path).Observe(responseTime.Seconds())
+		}
+
 		log.Info().Int("status", c.Response().StatusCode()).Str("method", c.Method()).Str("path", c.Path()).Str("response_time", responseTime.String()).Msg("Request")
 		return nil
 	})
 
-	statePool, err := pool.New(config, func(nuState *lua.State) error {
+	initializer := func(nuState *lua.State) error {
 		// TODO: considering reducing lib availibility in Lua
 		nuState.OpenLibs()
 
 		// Load modules to be used in the Lua code
 		// Unfortunately order does matter here
-		// Heart depends on context which depends on JSON
+		// Heart depends on context and websocket which depend on JSON like pubsub does
+		// and sessions depend on JSON and KV
 		err := modules.LoadJSON(nuState)
 		if err != nil {
 			return err
@@ -78,32 +121,173 @@ func main() {
 			return err
 		}
 
-		err = modules.LoadHeart(app, nuState)
+		err = modules.LoadSession(nuState)
+		if err != nil {
+			return err
+		}
+
+		err = modules.LoadPubSub(nuState)
+		if err != nil {
+			return err
+		}
+
+		err = modules.LoadWebsocket(nuState)
+		if err != nil {
+			return err
+		}
+
+		err = modules.LoadHeart(nuState)
 		if err != nil {
 			return err
 		}
 
 		return nuState.DoFile(config.Path)
-	})
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to initialize lua state")
 	}
-	defer statePool.Cleanup()
-	defer kv.CloseStores()
 
-	// This function grabs one of the initialStates from the pool to build up the fiber routes
-	// It's worth noting that this means that app routes can't be built up dynamically
-	// But that's probably not a good idea anyway and implementing it would probably kill performance or me :(
-	build.Routes(app, statePool)
+	// the pool is swapped out on every reload in watch mode so the metrics need a way to get the current one
+	// and shutting down needs a way to close it
+	var currentPool func() *pool.Pool
+	var closeLua func()
+	if config.Watch {
+		// fiber can't unregister routes so in watch mode each generation of the Lua app gets its own *fiber.App
+		// and the reloader swaps between them
+		reloader, err := reload.New(config, func() *fiber.App {
+			return fiber.New(fiberConfig)
+		}, initializer)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize lua state")
+		}
+		currentPool = reloader.Pool
+		closeLua = reloader.Close
+
+		app.Use(reloader.Handler)
+
+		log.Info().Msg("Watching the Lua source for changes")
+		go reloader.Watch(500 * time.Millisecond)
+	} else {
+		statePool, err := pool.New(config, initializer)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize lua state")
+		}
+		currentPool = func() *pool.Pool { return statePool }
+
+		// This function grabs one of the initialStates from the pool to build up the fiber routes
+		// It's worth noting that this means that app routes can't be built up dynamically
+		// But that's probably not a good idea anyway and implementing it would probably kill performance or me :(
+		build.Routes(app, statePool)
+		stopWatchers := build.Watchers(statePool)
+		closeLua = func() {
+			stopWatchers()
+			statePool.Close()
+		}
+	}
+
+	if config.Metrics {
+		registerRuntimeMetrics(currentPool)
+	}
 
 	// swap out the log's writer for a non-blocking one
 	// this greatly increases logging throughput
+	// it buffers so it's closed last to flush whatever was logged while shutting down
+	closeLog := func() {}
 	if config.Production {
 		nonBlockingWriter := diode.NewWriter(os.Stdout, 10000, 1*time.Millisecond, func(missed int) {})
-		defer nonBlockingWriter.Close()
+		closeLog = func() { nonBlockingWriter.Close() }
 		log.Logger = log.Output(nonBlockingWriter)
 	}
 
+	// Listen returns nil once the app has been shut down
+	go func() {
+		err := app.Listen(":" + config.Port)
+		if err != nil {
+			log.Fatal().Err(err).Msg("App failed to run")
+		}
+	}()
 	log.Info().Str("port", config.Port).Msg("Heart is online 💜")
-	log.Fatal().Err(app.Listen(":" + config.Port)).Msg("App failed to run")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	received := <-signals
+	log.Info().Str("signal", received.String()).Msg("Shutting down")
+
+	shutdown(app, closeLua, kv.SyncStores, kv.CloseStores, config.ShutdownTimeout)
+	log.Info().Msg("Heart is offline 💔")
+	closeLog()
+}
+
+// shutdown stops accepting connections and waits for in-flight requests to finish before closing the Lua state and then the KV stores
+// whatever is still running after the timeout is abandoned so the process can exit
+// the KV stores are only synced in that case since closing badger underneath running handlers could lose their writes
+// and badger replays its logs the next time it's opened anyway
+func shutdown(app *fiber.App, closeLua func(), syncStores func(), closeStores func(), timeout time.Duration) {
+	// subscribers block until a message comes in so they're woken up to let their handlers finish
+	pubsub.Default.Close()
+
+	// streams last for as long as the client keeps reading and the app can't shut down while they're being written
+	build.CloseStreams()
+
+	drained := make(chan struct{})
+	go func() {
+		err := app.Shutdown()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to shut down the app")
+		}
+
+		// websockets stay open until one side closes them so the server has to
+		build.CloseWebsockets()
+
+		closeLua()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+		closeStores()
+	case <-timer.C:
+		log.Warn().Str("timeout", timeout.String()).Msg("Timed out draining requests")
+		log.Error().Msg("Leaving the KV stores open because Lua is still running")
+
+		// what was written before the timeout still has to make it to disk when writes aren't synced as they happen
+		syncStores()
+	}
+}
+
+// register the metrics that are read from the pool and the KV stores when /metrics is scraped
+func registerRuntimeMetrics(currentPool func() *pool.Pool) {
+	metrics.NewGaugeFunc("heart_pool_size", "Lua states owned by the pool", func() float64 {
+		return float64(currentPool().Stats().Size)
+	})
+	metrics.NewGaugeFunc("heart_pool_in_use", "Lua states taken from the pool", func() float64 {
+		return float64(currentPool().Stats().InUse)
+	})
+	metrics.NewGaugeFunc("heart_pool_idle", "Lua states waiting in the pool", func() float64 {
+		return float64(currentPool().Stats().Idle)
+	})
+	metrics.NewGaugeFunc("heart_pool_waiting", "Requests waiting for lua state", func() float64 {
+		return float64(currentPool().Stats().Waiting)
+	})
+	metrics.NewGaugeFunc("heart_pool_detached", "Lua states running outside of the pool like websocket connections", func() float64 {
+		return float64(currentPool().Stats().Detached)
+	})
+
+	// every open store is reported, including the named ones opened by the app
+	metrics.NewLabeledGaugeFunc("heart_kv_lsm_size_bytes", "Size of the KV store's LSM tree", "store", func() map[string]float64 {
+		sizes := make(map[string]float64)
+		for name, store := range kv.Stores() {
+			lsm, _ := store.Size()
+			sizes[name] = float64(lsm)
+		}
+		return sizes
+	})
+	metrics.NewLabeledGaugeFunc("heart_kv_vlog_size_bytes", "Size of the KV store's value log", "store", func() map[string]float64 {
+		sizes := make(map[string]float64)
+		for name, store := range kv.Stores() {
+			_, vlog := store.Size()
+			sizes[name] = float64(vlog)
+		}
+		return sizes
+	})
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestShutdownClosesStoresAfterLua(t *testing.T) {
+	var luaClosed, storesClosed int32
+
+	shutdown(fiber.New(), func() {
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&luaClosed, 1)
+	}, func() {}, func() {
+		if atomic.LoadInt32(&luaClosed) == 0 {
+			t.Error("the stores were closed before the Lua state")
+		}
+		atomic.StoreInt32(&storesClosed, 1)
+	}, time.Second)
+
+	if atomic.LoadInt32(&storesClosed) == 0 {
+		t.Error("the stores weren't closed once the Lua state was")
+	}
+}
+
+func TestShutdownSyncsStoresForAbandonedLua(t *testing.T) {
+	running := make(chan struct{})
+	defer close(running)
+
+	var storesSynced, storesClosed int32
+	shutdown(fiber.New(), func() {
+		// a handler that's still running when the timeout passes
+		<-running
+	}, func() {
+		atomic.StoreInt32(&storesSynced, 1)
+	}, func() {
+		atomic.StoreInt32(&storesClosed, 1)
+	}, 50*time.Millisecond)
+
+	if atomic.LoadInt32(&storesClosed) != 0 {
+		t.Error("the stores were closed while Lua was still running")
+	}
+	if atomic.LoadInt32(&storesSynced) == 0 {
+		t.Error("the stores weren't synced when Lua was abandoned")
+	}
+}
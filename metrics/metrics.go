@@ -0,0 +1,95 @@
+// Package metrics registers Heart's Prometheus metrics
+// they're kept in their own registry so the /metrics endpoint only reports Heart and the Go runtime it runs on
+package metrics
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultBuckets for latency histograms in seconds
+var DefaultBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(prometheus.NewGoCollector())
+	registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+}
+
+// Handler serves every registered metric in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// NewCounter registers a counter without labels
+func NewCounter(name, help string) prometheus.Counter {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: help})
+	registry.MustRegister(counter)
+
+	return counter
+}
+
+// NewCounterVec registers a family of counters with the given label names
+func NewCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	registry.MustRegister(vec)
+
+	return vec
+}
+
+// NewHistogram registers a histogram without labels
+func NewHistogram(name, help string, buckets []float64) prometheus.Histogram {
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets})
+	registry.MustRegister(histogram)
+
+	return histogram
+}
+
+// NewHistogramVec registers a family of histograms with the given buckets and label names
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+	registry.MustRegister(vec)
+
+	return vec
+}
+
+// NewGaugeFunc registers a gauge that calls value every time the metrics are scraped
+func NewGaugeFunc(name, help string, value func() float64) {
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, value))
+}
+
+// NewLabeledGaugeFunc registers a family of gauges split up by the given label
+// values is called every time the metrics are scraped and maps each label value to its gauge value
+func NewLabeledGaugeFunc(name, help, label string, values func() map[string]float64) {
+	registry.MustRegister(&labeledGaugeFunc{
+		desc:   prometheus.NewDesc(name, help, []string{label}, nil),
+		values: values,
+	})
+}
+
+// labeledGaugeFunc collects gauges whose label values are only known when the metrics are scraped
+type labeledGaugeFunc struct {
+	desc   *prometheus.Desc
+	values func() map[string]float64
+}
+
+func (g *labeledGaugeFunc) Describe(descs chan<- *prometheus.Desc) {
+	descs <- g.desc
+}
+
+func (g *labeledGaugeFunc) Collect(metrics chan<- prometheus.Metric) {
+	values := g.values()
+	labelValues := make([]string, 0, len(values))
+	for labelValue := range values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		metrics <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, values[labelValue], labelValue)
+	}
+}
@@ -0,0 +1,66 @@
+package metrics_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sosodev/heart/metrics"
+)
+
+func TestHandler(t *testing.T) {
+	requests := metrics.NewCounterVec("test_requests_total", "Requests handled", "method", "route")
+	requests.WithLabelValues("GET", "/").Inc()
+	requests.WithLabelValues("GET", "/").Inc()
+	requests.WithLabelValues("POST", `/say "hi"`).Add(3)
+
+	latency := metrics.NewHistogram("test_latency_seconds", "Request latency", []float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	metrics.NewGaugeFunc("test_pool_size", "Pool size", func() float64 { return 8 })
+	metrics.NewLabeledGaugeFunc("test_store_size_bytes", "Store size", "store", func() map[string]float64 {
+		return map[string]float64{"memory": 1024, "disk": 2048}
+	})
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	output, err := ioutil.ReadAll(recorder.Body)
+	if err != nil {
+		t.Fatalf("failed to read metrics: %s", err)
+	}
+
+	expected := []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{method="GET",route="/"} 2`,
+		`test_requests_total{method="POST",route="/say \"hi\""} 3`,
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{le="0.1"} 1`,
+		`test_latency_seconds_bucket{le="1"} 2`,
+		`test_latency_seconds_bucket{le="+Inf"} 3`,
+		"test_latency_seconds_sum 5.55",
+		"test_latency_seconds_count 3",
+		"# TYPE test_pool_size gauge",
+		"test_pool_size 8",
+		`test_store_size_bytes{store="disk"} 2048`,
+		`test_store_size_bytes{store="memory"} 1024`,
+	}
+
+	lines := strings.Split(string(output), "\n")
+	for _, line := range expected {
+		found := false
+		for _, written := range lines {
+			if written == line {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			t.Errorf("missing line %q in:\n%s", line, output)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package modules
 
 import (
+	"io/ioutil"
+	"time"
+
 	"github.com/aarzilli/golua/lua"
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog/log"
@@ -14,23 +17,25 @@ var (
 	contextLua string // embedding the matching lua file for the module
 )
 
+// get the *fiber.Ctx of the request the state is handling
+// raises a Lua error when there isn't one, like in a stream, websocket or KV watcher, instead of handing back nil
+func requestCtx(state *lua.State) *fiber.Ctx {
+	as, ok := las.Get(state)
+	if !ok || as.Ctx == nil {
+		state.RaiseError("ctx can only be used while handling a request")
+	}
+
+	return as.Ctx
+}
+
 // LoadContext creates a module for request context
 // Functionally it just provides cute bindings to some go functions that can appropriately bridge lua<->fiber
 func LoadContext(state *lua.State) error {
-	ctx := func(state *lua.State) *fiber.Ctx {
-		as, ok := las.Get(state)
-		if !ok {
-			log.Fatal().Msg("Failed to load *las.AssociatedState for request")
-		}
-
-		return as.Ctx
-	}
-
 	state.Register("_redirect", func(state *lua.State) int {
 		path := state.ToString(state.GetTop() - 1)
 		code := state.ToInteger(state.GetTop())
 
-		err := ctx(state).Redirect(path, code)
+		err := requestCtx(state).Redirect(path, code)
 		if err != nil {
 			log.Error().Err(err).Msg("Failed to redirect")
 		}
@@ -40,27 +45,27 @@ func LoadContext(state *lua.State) error {
 
 	state.Register("_path_param", func(state *lua.State) int {
 		key := state.ToString(state.GetTop())
-		state.PushString(ctx(state).Params(key))
+		state.PushString(requestCtx(state).Params(key))
 		return 1
 	})
 
 	state.Register("_form_param", func(state *lua.State) int {
-		state.PushString(ctx(state).FormValue(state.ToString(state.GetTop())))
+		state.PushString(requestCtx(state).FormValue(state.ToString(state.GetTop())))
 		return 1
 	})
 
 	state.Register("_query_param", func(state *lua.State) int {
-		state.PushString(ctx(state).Query(state.ToString(state.GetTop())))
+		state.PushString(requestCtx(state).Query(state.ToString(state.GetTop())))
 		return 1
 	})
 
 	state.Register("_path", func(state *lua.State) int {
-		state.PushString(ctx(state).Path())
+		state.PushString(requestCtx(state).Path())
 		return 1
 	})
 
 	state.Register("_get_header", func(state *lua.State) int {
-		state.PushString(ctx(state).Get(state.ToString(state.GetTop())))
+		state.PushString(requestCtx(state).Get(state.ToString(state.GetTop())))
 		return 1
 	})
 
@@ -68,68 +73,277 @@ func LoadContext(state *lua.State) error {
 		key := state.ToString(state.GetTop() - 1)
 		value := state.ToString(state.GetTop())
 
-		ctx(state).Set(key, value)
+		requestCtx(state).Set(key, value)
 
 		return 0
 	})
 
 	state.Register("_body", func(state *lua.State) int {
-		state.PushString(string(ctx(state).Body()))
+		pushBytes(state, requestCtx(state).Body())
+		return 1
+	})
+
+	state.Register("_send", func(state *lua.State) int {
+		body := state.ToBytes(state.GetTop() - 1)
+		contentType := state.ToString(state.GetTop())
+
+		if contentType != "" {
+			requestCtx(state).Set(fiber.HeaderContentType, contentType)
+		}
+
+		err := requestCtx(state).Send(body)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to send body")
+		}
+
+		return 0
+	})
+
+	// the server runs the callback once the handler has returned
+	// a handler that streams more than once only streams with the last callback
+	state.Register("_stream", func(state *lua.State) int {
+		contentType := state.ToString(2)
+		if contentType != "" {
+			requestCtx(state).Set(fiber.HeaderContentType, contentType)
+		}
+
+		state.PushValue(1)
+		ref := state.Ref(lua.LUA_REGISTRYINDEX)
+
+		err := las.Update(state, func(as *las.AssociatedState) error {
+			if as.Stream != 0 {
+				state.Unref(lua.LUA_REGISTRYINDEX, as.Stream)
+			}
+
+			as.Stream = ref
+			return nil
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to start stream")
+		}
+
+		return 0
+	})
+
+	state.Register("_stream_write", func(state *lua.State) int {
+		as, ok := las.Get(state)
+		if !ok || as.StreamWriter == nil {
+			state.PushString("there is no stream to write to")
+			return 1
+		}
+
+		_, err := as.StreamWriter.Write(state.ToBytes(1))
+		if err == nil {
+			err = as.StreamWriter.Flush()
+		}
+		if err != nil {
+			state.PushString(err.Error())
+			return 1
+		}
+
+		return 0
+	})
+
+	state.Register("_files", func(state *lua.State) int {
+		name := state.ToString(state.GetTop())
+		state.NewTable()
+
+		form, err := requestCtx(state).MultipartForm()
+		if err != nil {
+			log.Debug().Err(err).Msg("Failed to parse multipart form")
+			return 1
+		}
+
+		// files that fail to open or read are skipped so the index only counts the ones that made it
+		index := 0
+		for _, header := range form.File[name] {
+			file, err := header.Open()
+			if err != nil {
+				log.Error().Err(err).Str("filename", header.Filename).Msg("Failed to open uploaded file")
+				continue
+			}
+
+			contents, err := ioutil.ReadAll(file)
+			file.Close()
+			if err != nil {
+				log.Error().Err(err).Str("filename", header.Filename).Msg("Failed to read uploaded file")
+				continue
+			}
+
+			state.NewTable()
+			state.PushString(header.Filename)
+			state.SetField(state.GetTop()-1, "filename")
+
+			state.PushInteger(header.Size)
+			state.SetField(state.GetTop()-1, "size")
+
+			state.PushString(header.Header.Get(fiber.HeaderContentType))
+			state.SetField(state.GetTop()-1, "contentType")
+
+			pushBytes(state, contents)
+			state.SetField(state.GetTop()-1, "contents")
+
+			index++
+			state.RawSeti(state.GetTop()-1, index)
+		}
+
+		return 1
+	})
+
+	state.Register("_save_file", func(state *lua.State) int {
+		name := state.ToString(state.GetTop() - 1)
+		dest := state.ToString(state.GetTop())
+
+		header, err := requestCtx(state).FormFile(name)
+		if err != nil {
+			state.PushBoolean(false)
+			state.PushString(err.Error())
+			return 2
+		}
+
+		err = requestCtx(state).SaveFile(header, dest)
+		if err != nil {
+			log.Error().Err(err).Str("dest", dest).Msg("Failed to save uploaded file")
+			state.PushBoolean(false)
+			state.PushString(err.Error())
+			return 2
+		}
+
+		state.PushBoolean(true)
 		return 1
 	})
 
 	state.Register("_set_status", func(state *lua.State) int {
-		ctx(state).Status(state.ToInteger(state.GetTop()))
+		requestCtx(state).Status(state.ToInteger(state.GetTop()))
 		return 0
 	})
 
 	state.Register("_get_cookie", func(state *lua.State) int {
-		state.PushString(ctx(state).Cookies(state.ToString(state.GetTop() - 1)))
+		state.PushString(requestCtx(state).Cookies(state.ToString(state.GetTop())))
 		return 1
 	})
 
 	state.Register("_set_cookie", func(state *lua.State) int {
-		ctx(state).Cookie(&fiber.Cookie{
-			Name:  state.ToString(state.GetTop() - 1),
-			Value: state.ToString(state.GetTop()),
-		})
+		cookie := toCookie(state)
+		requestCtx(state).Cookie(cookie)
+		return 0
+	})
+
+	// the signed and encrypted getters push nil when the cookie is missing or was tampered with
+	// they all raise an error when there's no secret key to sign or encrypt with
+	state.Register("_get_signed_cookie", func(state *lua.State) int {
+		name := state.ToString(state.GetTop())
+		value, ok := cookieSigner.get(state).Verify(name, requestCtx(state).Cookies(name))
+		if !ok {
+			state.PushNil()
+			return 1
+		}
+
+		state.PushString(value)
+		return 1
+	})
+
+	state.Register("_set_signed_cookie", func(state *lua.State) int {
+		cookie := toCookie(state)
+		cookie.Value = cookieSigner.get(state).Sign(cookie.Name, cookie.Value)
+		requestCtx(state).Cookie(cookie)
+		return 0
+	})
+
+	state.Register("_get_encrypted_cookie", func(state *lua.State) int {
+		name := state.ToString(state.GetTop())
+		value, ok := cookieCipher.get(state).Decrypt(name, requestCtx(state).Cookies(name))
+		if !ok {
+			state.PushNil()
+			return 1
+		}
+
+		state.PushString(value)
+		return 1
+	})
+
+	state.Register("_set_encrypted_cookie", func(state *lua.State) int {
+		cookie := toCookie(state)
+
+		value, err := cookieCipher.get(state).Encrypt(cookie.Name, cookie.Value)
+		if err != nil {
+			log.Error().Err(err).Str("cookie", cookie.Name).Msg("Failed to encrypt cookie")
+			state.PushString(err.Error())
+			return 1
+		}
+
+		cookie.Value = value
+		requestCtx(state).Cookie(cookie)
 		return 0
 	})
 
 	state.Register("_clear_cookie", func(state *lua.State) int {
-		ctx(state).ClearCookie(state.ToString(state.GetTop()))
+		requestCtx(state).ClearCookie(state.ToString(state.GetTop()))
 		return 0
 	})
 
 	state.Register("_clear_cookies", func(state *lua.State) int {
-		ctx(state).ClearCookie()
+		requestCtx(state).ClearCookie()
 		return 0
 	})
 
 	state.Register("_host", func(state *lua.State) int {
-		state.PushString(ctx(state).Hostname())
+		state.PushString(requestCtx(state).Hostname())
 		return 1
 	})
 
 	state.Register("_ip", func(state *lua.State) int {
-		state.PushString(ctx(state).IP())
+		state.PushString(requestCtx(state).IP())
 		return 1
 	})
 
 	state.Register("_method", func(state *lua.State) int {
-		state.PushString(ctx(state).Method())
+		state.PushString(requestCtx(state).Method())
 		return 1
 	})
 
 	state.Register("_path", func(state *lua.State) int {
-		state.PushString(ctx(state).Path())
+		state.PushString(requestCtx(state).Path())
 		return 1
 	})
 
 	state.Register("_protocol", func(state *lua.State) int {
-		state.PushString(ctx(state).Protocol())
+		state.PushString(requestCtx(state).Protocol())
 		return 1
 	})
 
 	return state.DoString(contextLua)
 }
+
+// toCookie reads the arguments of the cookie setters which are the name, value, path, domain,
+// expires (a unix timestamp in seconds or 0), maxAge (in seconds), secure, httpOnly and sameSite
+func toCookie(state *lua.State) *fiber.Cookie {
+	cookie := &fiber.Cookie{
+		Name:     state.ToString(1),
+		Value:    state.ToString(2),
+		Path:     state.ToString(3),
+		Domain:   state.ToString(4),
+		MaxAge:   state.ToInteger(6),
+		Secure:   state.ToBoolean(7),
+		HTTPOnly: state.ToBoolean(8),
+		SameSite: state.ToString(9),
+	}
+
+	expires := state.ToNumber(5)
+	if expires > 0 {
+		cookie.Expires = time.Unix(int64(expires), 0)
+	}
+
+	return cookie
+}
+
+// pushBytes onto the stack without going through a Go string so the bytes stay exact
+// lua.State.PushBytes can't handle an empty slice so that's pushed as an empty string instead
+func pushBytes(state *lua.State, b []byte) {
+	if len(b) == 0 {
+		state.PushString("")
+		return
+	}
+
+	state.PushBytes(b)
+}
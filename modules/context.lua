@@ -19,6 +19,18 @@ package.preload['heart.v1.context'] = function()
     return _form_param(key)
   end
 
+  -- get the files uploaded under the given multipart form key
+  -- each file is a table with filename, size, contentType and contents
+  function context.files(name)
+    return _files(name)
+  end
+
+  -- save the first file uploaded under the given multipart form key to dest
+  -- returns true on success or false and an error message
+  function context.saveFile(name, dest)
+    return _save_file(name, dest)
+  end
+
   -- get the value of a query param by key
   function context.queryParam(key)
     return _query_param(key)
@@ -39,13 +51,55 @@ package.preload['heart.v1.context'] = function()
     end
   end
 
+  -- call the cookie setter with the options spread out the way the bindings take them
+  local function setCookie(setter, key, value, options)
+    options = options or {}
+    return setter(
+      key,
+      tostring(value),
+      options.path or '',
+      options.domain or '',
+      options.expires or 0,
+      options.maxAge or 0,
+      options.secure == true,
+      options.httpOnly == true,
+      options.sameSite or ''
+    )
+  end
+
   -- get a cookie by passing a key with no value
   -- set a cookie by passing a key with a non-nil value
-  function context.cookies(key, value)
+  -- options are optional and can set path, domain, expires (a unix timestamp like os.time() returns),
+  -- maxAge (in seconds), secure, httpOnly and sameSite ('Lax', 'Strict' or 'None', default 'Lax')
+  function context.cookies(key, value, options)
     if value == nil then
       return _get_cookie(key)
     else
-      _set_cookie(key, value)
+      setCookie(_set_cookie, key, value, options)
+    end
+  end
+
+  -- signed and encrypted cookies raise an error in production when SECRET_KEY isn't set
+
+  -- get or set a cookie that's signed with the SECRET_KEY so the client can read it but not change it
+  -- the signature covers the cookie's name so a value can't be moved from one signed cookie to another
+  -- getting it returns nil if it's missing or was tampered with and setting it takes the same options as cookies
+  function context.signedCookies(key, value, options)
+    if value == nil then
+      return _get_signed_cookie(key)
+    else
+      setCookie(_set_signed_cookie, key, value, options)
+    end
+  end
+
+  -- get or set a cookie that's encrypted with the SECRET_KEY so the client can neither read it nor change it
+  -- getting it returns nil if it's missing or was tampered with and setting it takes the same options as cookies
+  -- setting it returns an error message if the value couldn't be encrypted in which case the cookie isn't set
+  function context.encryptedCookies(key, value, options)
+    if value == nil then
+      return _get_encrypted_cookie(key)
+    else
+      return setCookie(_set_encrypted_cookie, key, value, options)
     end
   end
 
@@ -72,7 +126,68 @@ package.preload['heart.v1.context'] = function()
     return json.encode(table)
   end
 
-  -- returns a body object that exposes a string() and json() function to get the body in either format
+  -- send the given bytes as the response body exactly as they are
+  -- contentType is optional and sets the Content-Type header when given
+  -- return nil from the handler afterwards so the body isn't replaced
+  function context.send(bytes, contentType)
+    _send(bytes, contentType or '')
+  end
+
+  -- stream the response by calling the callback with a write function once the handler returns
+  -- every chunk passed to write is flushed to the client right away
+  -- write raises an error once the client disconnects which ends the stream
+  -- contentType is optional and sets the Content-Type header when given
+  -- return nil from the handler afterwards and don't use ctx in the callback since the request is over by then
+  -- the callback runs on its own state for up to the STREAM_TIMEOUT, or the route's streamTimeout option
+  -- and is aborted when the server shuts down
+  function context.stream(callback, contentType)
+    local function write(chunk)
+      local err = _stream_write(chunk)
+      if err ~= nil then
+        error(err, 2)
+      end
+    end
+
+    _stream(function()
+      callback(write)
+    end, contentType or '')
+  end
+
+  -- stream server-sent events by calling the callback with a send function once the handler returns
+  -- send takes the event's data, tables are encoded as JSON, and options with event, id and retry (in milliseconds)
+  -- it follows the same rules as ctx.stream
+  function context.sse(callback)
+    _set_header('Cache-Control', 'no-cache')
+
+    context.stream(function(write)
+      callback(function(data, options)
+        options = options or {}
+        if type(data) == 'table' then
+          data = json.encode(data)
+        end
+
+        local event = ''
+        if options.event ~= nil then
+          event = event .. 'event: ' .. options.event .. '\n'
+        end
+        if options.id ~= nil then
+          event = event .. 'id: ' .. options.id .. '\n'
+        end
+        if options.retry ~= nil then
+          event = event .. 'retry: ' .. options.retry .. '\n'
+        end
+
+        -- every line of the data needs its own field
+        for line in (tostring(data) .. '\n'):gmatch('(.-)\r?\n') do
+          event = event .. 'data: ' .. line .. '\n'
+        end
+
+        write(event .. '\n')
+      end)
+    end, 'text/event-stream')
+  end
+
+  -- returns a body object that exposes string(), bytes() and json() functions to get the body in any format
   function context.body()
     local body = {value = _body()}
 
@@ -80,6 +195,11 @@ package.preload['heart.v1.context'] = function()
       return body.value
     end
 
+    -- the raw bytes of the body which are safe to use for binary payloads like images
+    function body.bytes()
+      return body.value
+    end
+
     function body.json()
       if body.value == '' then
         return {}
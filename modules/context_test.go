@@ -0,0 +1,317 @@
+package modules_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sosodev/heart/las"
+	"github.com/sosodev/heart/modules"
+)
+
+func binaryFixtures() map[string][]byte {
+	allBytes := make([]byte, 256)
+	for i := range allBytes {
+		allBytes[i] = byte(i)
+	}
+
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	return map[string][]byte{
+		"empty":        {},
+		"only nul":     {0, 0, 0, 0},
+		"embedded nul": []byte("before\x00after"),
+		"trailing nul": []byte("text\x00"),
+		"png header":   {0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0, 0, 0, 0x0d, 'I', 'H', 'D', 'R'},
+		"all bytes":    allBytes,
+		"random":       random,
+	}
+}
+
+func TestBinaryBodies(t *testing.T) {
+	state := lua.NewState()
+	defer state.Close()
+	defer las.Free(state)
+	state.OpenLibs()
+
+	err := modules.LoadJSON(state)
+	if err != nil {
+		t.Fatalf("failed to load json module: %s", err)
+	}
+
+	err = modules.LoadContext(state)
+	if err != nil {
+		t.Fatalf("failed to load context module: %s", err)
+	}
+
+	app := fiber.New()
+	app.Post("/echo", func(ctx *fiber.Ctx) error {
+		err := las.Update(state, func(as *las.AssociatedState) error {
+			as.Ctx = ctx
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return state.DoString(`
+			local ctx = require('heart.v1.context')
+			ctx.send(ctx.body().bytes(), 'application/octet-stream')
+		`)
+	})
+
+	for name, fixture := range binaryFixtures() {
+		req := httptest.NewRequest("POST", "/echo", bytes.NewReader(fixture))
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("%s: request failed: %s", name, err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("%s: failed to read response body: %s", name, err)
+		}
+
+		if !bytes.Equal(body, fixture) {
+			t.Errorf("%s: body changed in transit, expected %d bytes got %d", name, len(fixture), len(body))
+		}
+
+		if contentType := resp.Header.Get(fiber.HeaderContentType); contentType != "application/octet-stream" {
+			t.Errorf("%s: incorrect content type %s", name, contentType)
+		}
+	}
+}
+
+func TestCookies(t *testing.T) {
+	state := lua.NewState()
+	defer state.Close()
+	defer las.Free(state)
+	state.OpenLibs()
+
+	err := modules.LoadJSON(state)
+	if err != nil {
+		t.Fatalf("failed to load json module: %s", err)
+	}
+
+	err = modules.LoadContext(state)
+	if err != nil {
+		t.Fatalf("failed to load context module: %s", err)
+	}
+
+	app := fiber.New()
+	handle := func(path, code string) {
+		app.Get(path, func(ctx *fiber.Ctx) error {
+			err := las.Update(state, func(as *las.AssociatedState) error {
+				as.Ctx = ctx
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			return state.DoString(code)
+		})
+	}
+
+	handle("/set", `
+		local ctx = require('heart.v1.context')
+		ctx.cookies('plain', 'value', {path = '/', maxAge = 60, secure = true, httpOnly = true, sameSite = 'Strict'})
+		ctx.signedCookies('signed', 'user-1')
+		ctx.signedCookies('signed2', 'user-2')
+		ctx.headers('X-Encrypt-Error', tostring(ctx.encryptedCookies('encrypted', 'secret')))
+		ctx.encryptedCookies('encrypted2', 'other secret')
+	`)
+
+	handle("/get", `
+		local ctx = require('heart.v1.context')
+		ctx.headers('X-Plain', ctx.cookies('plain'))
+		ctx.headers('X-Signed', ctx.signedCookies('signed') or 'nil')
+		ctx.headers('X-Encrypted', ctx.encryptedCookies('encrypted') or 'nil')
+	`)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/set", nil))
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	cookies := make(map[string]*http.Cookie)
+	for _, cookie := range resp.Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+
+	plain := cookies["plain"]
+	if plain == nil || plain.Value != "value" || plain.Path != "/" || plain.MaxAge != 60 || !plain.Secure || !plain.HttpOnly || plain.SameSite != http.SameSiteStrictMode {
+		t.Errorf("plain cookie didn't get its options: %+v", plain)
+	}
+
+	if cookies["signed"] == nil || cookies["encrypted"] == nil || cookies["signed2"] == nil || cookies["encrypted2"] == nil {
+		t.Fatalf("signed and encrypted cookies should be set but got %v", cookies)
+	}
+
+	if encryptErr := resp.Header.Get("X-Encrypt-Error"); encryptErr != "nil" {
+		t.Errorf("encrypting the cookie shouldn't fail but got %q", encryptErr)
+	}
+
+	if strings.Contains(cookies["encrypted"].Value, "secret") {
+		t.Errorf("encrypted cookie is readable: %s", cookies["encrypted"].Value)
+	}
+
+	get := func(signed, encrypted string) *http.Response {
+		req := httptest.NewRequest("GET", "/get", nil)
+		req.AddCookie(&http.Cookie{Name: "plain", Value: "value"})
+		req.AddCookie(&http.Cookie{Name: "signed", Value: signed})
+		req.AddCookie(&http.Cookie{Name: "encrypted", Value: encrypted})
+
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+
+		return resp
+	}
+
+	resp = get(cookies["signed"].Value, cookies["encrypted"].Value)
+	if plain := resp.Header.Get("X-Plain"); plain != "value" {
+		t.Errorf("expected plain cookie value but got %q", plain)
+	}
+	if signed := resp.Header.Get("X-Signed"); signed != "user-1" {
+		t.Errorf("expected signed cookie to verify but got %q", signed)
+	}
+	if encrypted := resp.Header.Get("X-Encrypted"); encrypted != "secret" {
+		t.Errorf("expected encrypted cookie to decrypt but got %q", encrypted)
+	}
+
+	signedValue := cookies["signed"].Value
+	resp = get("user-2"+signedValue[len("user-1"):], cookies["encrypted"].Value[1:])
+	if signed := resp.Header.Get("X-Signed"); signed != "nil" {
+		t.Errorf("tampered signed cookie should be nil but got %q", signed)
+	}
+	if encrypted := resp.Header.Get("X-Encrypted"); encrypted != "nil" {
+		t.Errorf("tampered encrypted cookie should be nil but got %q", encrypted)
+	}
+
+	// values are bound to the cookie they were set for so they can't be replayed under another name
+	resp = get(cookies["signed2"].Value, cookies["encrypted2"].Value)
+	if signed := resp.Header.Get("X-Signed"); signed != "nil" {
+		t.Errorf("a signed value from another cookie should be nil but got %q", signed)
+	}
+	if encrypted := resp.Header.Get("X-Encrypted"); encrypted != "nil" {
+		t.Errorf("an encrypted value from another cookie should be nil but got %q", encrypted)
+	}
+}
+
+func TestUploads(t *testing.T) {
+	state := lua.NewState()
+	defer state.Close()
+	defer las.Free(state)
+	state.OpenLibs()
+
+	err := modules.LoadJSON(state)
+	if err != nil {
+		t.Fatalf("failed to load json module: %s", err)
+	}
+
+	err = modules.LoadContext(state)
+	if err != nil {
+		t.Fatalf("failed to load context module: %s", err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "saved")
+
+	app := fiber.New()
+	app.Post("/upload", func(ctx *fiber.Ctx) error {
+		err := las.Update(state, func(as *las.AssociatedState) error {
+			as.Ctx = ctx
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return state.DoString(fmt.Sprintf(`
+			local ctx = require('heart.v1.context')
+
+			local files = ctx.files('files')
+			local described = {}
+			for _, file in ipairs(files) do
+				table.insert(described, file.filename .. ':' .. file.size .. ':' .. file.contentType)
+			end
+			ctx.headers('X-Files', table.concat(described, ','))
+			ctx.headers('X-Missing', tostring(#ctx.files('missing')))
+
+			local saved = ctx.saveFile('files', %q)
+			local missingSaved, err = ctx.saveFile('missing', %q)
+			ctx.headers('X-Saved', tostring(saved) .. ' ' .. tostring(missingSaved) .. ' ' .. tostring(err ~= nil))
+
+			ctx.send(files[2].contents, 'application/octet-stream')
+		`, dest, dest+"-missing"))
+	})
+
+	binary := binaryFixtures()["all bytes"]
+
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="files"; filename="notes.txt"`)
+	header.Set("Content-Type", "text/plain")
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatalf("failed to create part: %s", err)
+	}
+	part.Write([]byte("hello"))
+
+	part, err = form.CreateFormFile("files", "image.png")
+	if err != nil {
+		t.Fatalf("failed to create part: %s", err)
+	}
+	part.Write(binary)
+	form.Close()
+
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+
+	expected := fmt.Sprintf("notes.txt:5:text/plain,image.png:%d:application/octet-stream", len(binary))
+	if files := resp.Header.Get("X-Files"); files != expected {
+		t.Errorf("expected files %q but got %q", expected, files)
+	}
+
+	if missing := resp.Header.Get("X-Missing"); missing != "0" {
+		t.Errorf("a missing key should have no files but got %s", missing)
+	}
+
+	if saved := resp.Header.Get("X-Saved"); saved != "true false true" {
+		t.Errorf("only the first file should be saved but got %q", saved)
+	}
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %s", err)
+	}
+	if !bytes.Equal(contents, binary) {
+		t.Errorf("binary upload changed in transit, expected %d bytes got %d", len(binary), len(contents))
+	}
+
+	saved, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("failed to read the saved file: %s", err)
+	}
+	if string(saved) != "hello" {
+		t.Errorf("expected the first file to be saved but got %q", saved)
+	}
+}
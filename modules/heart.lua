@@ -1,54 +1,225 @@
 -- _heart holds all of the routing state for the app
 -- it's a global so it can be used anywhere in the app without being passed around as a single variable
 -- it also makes lookup easier
-_heart = {routes = {}, ctx = require('heart.v1.context')}
+_heart = {routes = {}, options = {}, middleware = {}, statics = {}, websockets = {}, ctx = require('heart.v1.context')}
 
-function registerCallback(method, path, callback)
+local json = require('heart.v1.json')
+
+-- options are kept apart from the callbacks so the server can read them without touching the routes
+function registerCallback(method, path, callback, options)
   if _heart.routes[path] == nil then
     _heart.routes[path] = {}
+    _heart.options[path] = {}
   end
 
   _heart.routes[path][method] = callback
+  _heart.options[path][method] = options or {}
 end
 
-function _heart.get(path, callback)
-  registerCallback('get', path, callback)
+-- join a router prefix and a path into a full route
+-- the root path of a prefixed router is the prefix itself
+local function join(prefix, path)
+  if prefix == '' then
+    return path
+  end
+
+  if path == '' or path == '/' then
+    return prefix
+  end
+
+  return prefix .. path
 end
 
-function _heart.head(path, callback)
-  registerCallback('head', path, callback)
+-- normalize a path the way the router does before matching it
+-- routing is case insensitive and ignores a trailing slash so middleware has to be too or it could be skipped
+local function normalize(path)
+  path = path:lower()
+  if #path > 1 and path:sub(-1) == '/' then
+    path = path:sub(1, -2)
+  end
+
+  return path
 end
 
-function _heart.post(path, callback)
-  registerCallback('post', path, callback)
+-- create a router that registers everything under the given prefix
+-- the app itself is a router with an empty prefix so groups get the exact same API
+local function newRouter(prefix)
+  local router = {}
+
+  -- options is optional and can set a timeout in seconds that overrides the global REQUEST_TIMEOUT
+  -- and a streamTimeout in seconds for ctx.stream and ctx.sse that overrides the global STREAM_TIMEOUT
+  -- setting either turns LuaJIT's compiler off for the state that runs the route so the timeout can always interrupt it
+  for _, method in ipairs({'get', 'head', 'post', 'put', 'delete', 'options', 'trace', 'patch'}) do
+    router[method] = function(path, callback, options)
+      registerCallback(method, join(prefix, path), callback, options)
+    end
+  end
+
+  -- register a websocket route, the callback gets the connection once the request is upgraded
+  -- every connection runs on its own state for as long as the callback runs, which closes the connection when it returns
+  -- middleware doesn't run for websocket routes and neither does the request timeout
+  function router.websocket(path, callback)
+    _heart.websockets[join(prefix, path)] = callback
+  end
+
+  -- register middleware that runs before the route handlers
+  -- the path is optional and scopes the middleware to requests under that path
+  -- middleware either returns a response to short-circuit or calls ctx.next() to continue down the chain
+  function router.use(path, callback)
+    if callback == nil then
+      callback = path
+      path = '/'
+    end
+
+    table.insert(_heart.middleware, {path = normalize(join(prefix, path)), callback = callback})
+  end
+
+  -- register a callback that runs before the route handlers
+  -- returning anything other than nil from the callback short-circuits the request with that response
+  function router.before(path, callback)
+    if callback == nil then
+      callback = path
+      path = '/'
+    end
+
+    router.use(path, function(ctx)
+      local body, status, headers = callback(ctx)
+      if body ~= nil then
+        return body, status, headers
+      end
+
+      return ctx.next()
+    end)
+  end
+
+  -- register a callback that runs after the route handlers with the handler's body, status and headers
+  -- returning anything other than nil from the callback replaces the response
+  function router.after(path, callback)
+    if callback == nil then
+      callback = path
+      path = '/'
+    end
+
+    router.use(path, function(ctx)
+      local body, status, headers = ctx.next()
+      local replacementBody, replacementStatus, replacementHeaders = callback(ctx, body, status, headers)
+      if replacementBody ~= nil then
+        return replacementBody, replacementStatus, replacementHeaders
+      end
+
+      return body, status, headers
+    end)
+  end
+
+  -- create a group of routes and middleware that share the given path prefix
+  -- the callback receives the group's router and the router is returned too
+  function router.group(path, callback)
+    local group = newRouter(join(prefix, path))
+    if callback ~= nil then
+      callback(group)
+    end
+
+    return group
+  end
+
+  return router
 end
 
-function _heart.put(path, callback)
-  registerCallback('put', path, callback)
+for name, value in pairs(newRouter('')) do
+  _heart[name] = value
 end
 
-function _heart.delete(path, callback)
-  registerCallback('delete', path, callback)
+-- serve the files under filepath on the given route
+-- any number of static mounts can be registered and they're served before the route handlers
+-- options is optional and can set compress, byteRange, browse, index, maxAge (in seconds)
+-- and spa which falls back to the index file for unmatched GET requests under the route
+-- static files and the spa fallback don't go through Lua so middleware doesn't run for them
+-- keep anything that needs auth out of static mounts and serve it from a route instead
+function _heart.static(route, filepath, options)
+  table.insert(_heart.statics, {route = route, filepath = filepath, options = options or {}})
 end
 
-function _heart.options(path, callback)
-  registerCallback('options', path, callback)
+function _heart.notfound(callback)
+  registerCallback('_not_found', '/', callback)
 end
 
-function _heart.trace(path, callback)
-  registerCallback('trace', path, callback)
+-- register a callback that renders the response when a handler raises an error
+-- it gets the context and an err table with the message and traceback
+-- and can return a body, status and headers just like a handler
+-- the status defaults to 500 when the callback doesn't set one
+function _heart.error(callback)
+  _heart.errorHandler = callback
 end
 
-function _heart.patch(path, callback)
-  registerCallback('patch', path, callback)
+-- check if the normalized middleware path covers the normalized request path
+-- '/api' covers '/api' and '/api/users' but not '/apiary'
+local function covers(path, requestPath)
+  if path == '/' or path == requestPath then
+    return true
+  end
+
+  return requestPath:sub(1, #path + 1) == path .. '/'
 end
 
-function _heart.static(route, filepath)
-  _static(route, filepath)
+-- normalize the values returned by a handler into a body, status and headers for the server
+-- tables are encoded as JSON and everything else except nil has to be a string or a number
+local function respond(body, status, headers)
+  if type(body) == 'table' then
+    _set_header('Content-Type', 'application/json')
+    body = json.encode(body)
+  elseif body ~= nil and type(body) ~= 'string' and type(body) ~= 'number' then
+    error('handler returned a ' .. type(body) .. ' which is not a valid response body')
+  end
+
+  if status ~= nil and type(status) ~= 'number' then
+    error('handler returned a ' .. type(status) .. ' which is not a valid response status')
+  end
+
+  if headers ~= nil and type(headers) ~= 'table' then
+    error('handler returned a ' .. type(headers) .. ' which is not a valid headers table')
+  end
+
+  return body, status, headers
 end
 
-function _heart.notfound(callback)
-  registerCallback('_not_found', '/', callback)
+-- dispatch a request through the middleware chain and into the route handler
+-- this is called by the server for every request so the whole chain runs on a single state
+-- handlers can return a body, a status and a table of headers which are all optional
+function _heart.dispatch(route, method, ctx)
+  local chain = {}
+  local requestPath = normalize(ctx.path())
+  for _, middleware in ipairs(_heart.middleware) do
+    if covers(middleware.path, requestPath) then
+      table.insert(chain, middleware.callback)
+    end
+  end
+  table.insert(chain, _heart.routes[route][method])
+
+  local index = 0
+  local function next()
+    index = index + 1
+    local handler = chain[index]
+    if handler == nil then
+      return nil
+    end
+
+    return handler(ctx)
+  end
+
+  ctx.next = next
+  return respond(next())
+end
+
+-- dispatch an error raised by a handler to the app's error handler
+-- this runs on a fresh state since the one that raised the error is thrown away
+function _heart.dispatchError(ctx, err)
+  return respond(_heart.errorHandler(ctx, err))
+end
+
+-- dispatch an upgraded connection to its websocket route
+-- this runs on a state that's dedicated to the connection
+function _heart.dispatchWebsocket(route)
+  return _heart.websockets[route](require('heart.v1.websocket'))
 end
 
 package.preload['heart.v1'] = function()
@@ -0,0 +1,195 @@
+package modules_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sosodev/heart/las"
+	"github.com/sosodev/heart/modules"
+)
+
+// newHeartApp runs the Lua app and serves the given GET routes through _heart.dispatch like the server does
+func newHeartApp(t *testing.T, source string, routes ...string) *fiber.App {
+	return newLuaApp(t, []func(*lua.State) error{modules.LoadJSON, modules.LoadContext, modules.LoadHeart}, source, routes...)
+}
+
+// newLuaApp is newHeartApp with the given modules loaded instead
+func newLuaApp(t *testing.T, loaders []func(*lua.State) error, source string, routes ...string) *fiber.App {
+	state := lua.NewState()
+	t.Cleanup(func() {
+		state.Close()
+		las.Free(state)
+	})
+	state.OpenLibs()
+
+	for _, load := range loaders {
+		err := load(state)
+		if err != nil {
+			t.Fatalf("failed to load modules: %s", err)
+		}
+	}
+
+	err := state.DoString(source)
+	if err != nil {
+		t.Fatalf("failed to run the app: %s", err)
+	}
+
+	app := fiber.New()
+	for _, route := range routes {
+		route := route
+		app.Get(route, func(ctx *fiber.Ctx) error {
+			err := las.Update(state, func(as *las.AssociatedState) error {
+				as.Ctx = ctx
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			return state.DoString(fmt.Sprintf(`
+				local body, status = _heart.dispatch(%q, 'get', _heart.ctx)
+				if status ~= nil then
+					_set_status(status)
+				end
+				_send(body or '', '')
+			`, route))
+		})
+	}
+
+	return app
+}
+
+// get the path and return the response's status and body
+func get(t *testing.T, app *fiber.App, path string) (int, string) {
+	resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+	if err != nil {
+		t.Fatalf("GET %s failed: %s", path, err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the body of GET %s: %s", path, err)
+	}
+
+	return resp.StatusCode, string(body)
+}
+
+func TestScopedMiddleware(t *testing.T) {
+	app := newHeartApp(t, `
+		local app = require('heart.v1')
+
+		app.group('/admin', function(admin)
+			admin.use(function(ctx)
+				if ctx.headers('Authorization') ~= 'Bearer hunter2' then
+					return 'unauthorized', 401
+				end
+
+				return ctx.next()
+			end)
+
+			admin.get('/stats', function(ctx)
+				return 'stats'
+			end)
+		end)
+
+		app.get('/administrators', function(ctx)
+			return 'not under /admin'
+		end)
+	`, "/admin/stats", "/administrators")
+
+	// the router is case insensitive and ignores trailing slashes so the middleware has to be too
+	for _, path := range []string{"/admin/stats", "/ADMIN/stats", "/Admin/Stats/", "/admin/stats/"} {
+		status, body := get(t, app, path)
+		if status != 401 || body != "unauthorized" {
+			t.Errorf("GET %s skipped the /admin middleware with %d %q", path, status, body)
+		}
+	}
+
+	status, body := get(t, app, "/administrators")
+	if status != 200 || body != "not under /admin" {
+		t.Errorf("/admin middleware shouldn't cover /administrators but got %d %q", status, body)
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	app := newHeartApp(t, `
+		local app = require('heart.v1')
+
+		app.use(function(ctx)
+			ctx.trail = 'use'
+			return ctx.next()
+		end)
+
+		app.before(function(ctx)
+			ctx.trail = ctx.trail .. ' before'
+		end)
+
+		app.after(function(ctx, body, status)
+			return body .. ' after', status
+		end)
+
+		app.before('/blocked', function(ctx)
+			return 'blocked', 403
+		end)
+
+		app.get('/', function(ctx)
+			return ctx.trail .. ' handler'
+		end)
+
+		app.get('/blocked', function(ctx)
+			return 'handler'
+		end)
+	`, "/", "/blocked")
+
+	status, body := get(t, app, "/")
+	if status != 200 || body != "use before handler after" {
+		t.Errorf("middleware ran out of order: %d %q", status, body)
+	}
+
+	// before short-circuits the handler but the after hook registered ahead of it still runs
+	status, body = get(t, app, "/blocked")
+	if status != 403 || body != "blocked after" {
+		t.Errorf("before should short-circuit the handler: %d %q", status, body)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	app := newHeartApp(t, `
+		local app = require('heart.v1')
+
+		local api = app.group('/api')
+		api.use(function(ctx)
+			local body, status = ctx.next()
+			return 'api:' .. body, status
+		end)
+
+		api.get('/', function(ctx)
+			return 'root'
+		end)
+
+		api.group('/v1', function(v1)
+			v1.use(function(ctx)
+				local body, status = ctx.next()
+				return 'v1:' .. body, status
+			end)
+
+			v1.get('/users/:id', function(ctx)
+				return 'user ' .. ctx.pathParam('id')
+			end)
+		end)
+	`, "/api", "/api/v1/users/:id")
+
+	status, body := get(t, app, "/api")
+	if status != 200 || body != "api:root" {
+		t.Errorf("the group's root route should be the prefix: %d %q", status, body)
+	}
+
+	status, body = get(t, app, "/api/v1/users/7")
+	if status != 200 || body != "api:v1:user 7" {
+		t.Errorf("nested groups should run their middleware outside in: %d %q", status, body)
+	}
+}
@@ -1,10 +1,8 @@
 package modules
 
 import (
-	"bytes"
 	"fmt"
 	"math/rand"
-	"text/template"
 	"time"
 
 	"github.com/aarzilli/golua/lua"
@@ -12,6 +10,13 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/sosodev/heart/kv"
 	"github.com/sosodev/heart/las"
+
+	_ "embed"
+)
+
+var (
+	//go:embed kv.lua
+	kvLua string
 )
 
 // LoadKV modules into Lua
@@ -60,16 +65,24 @@ func LoadKV(state *lua.State) error {
 		return func(state *lua.State) int {
 			key := state.ToString(state.GetTop())
 
-			value, err := store.Get(key)
+			value, ttl, err := store.GetWithTTL(key)
 			if err != nil {
 				log.Error().Str("key", key).Err(err).Msg("kv.get failed")
-				state.PushString("")
-				return 1
+				state.PushNil()
+				state.PushString(err.Error())
+				return 2
 			}
 
 			state.PushString(value)
 
-			return 1
+			// keys that never expire don't have a TTL
+			if ttl <= 0 {
+				state.PushNil()
+			} else {
+				state.PushNumber(ttl.Seconds())
+			}
+
+			return 2
 		}
 	}
 
@@ -119,119 +132,243 @@ func LoadKV(state *lua.State) error {
 		}
 	}
 
-	storeGet := func(store *kv.KV) func(*lua.State) int {
+	kvScan := func(store *kv.KV) func(*lua.State) int {
 		return func(state *lua.State) int {
-			key := state.ToString(state.GetTop())
+			top := state.GetTop()
+			options := kv.ScanOptions{
+				Prefix:  state.ToString(top - 5),
+				Start:   state.ToString(top - 4),
+				Stop:    state.ToString(top - 3),
+				Reverse: state.ToBoolean(top - 2),
+				Limit:   state.ToInteger(top - 1),
+				Cursor:  state.ToString(top),
+			}
 
-			value, err := store.TransactionGet(key)
+			results, cursor, err := store.Scan(options)
 			if err != nil {
-				log.Error().Str("key", key).Err(err).Msgf("store.get failed")
-				state.PushString("")
-				return 1
+				log.Error().Err(err).Msg("kv.scan failed")
+				state.NewTable()
+				state.PushNil()
+				state.PushString(err.Error())
+				return 3
 			}
 
-			state.PushString(value)
+			state.NewTable()
+			for i, result := range results {
+				state.NewTable()
+				state.PushString(result.Key)
+				state.SetField(state.GetTop()-1, "key")
 
-			return 1
+				state.PushString(result.Value)
+				state.SetField(state.GetTop()-1, "value")
+
+				state.RawSeti(state.GetTop()-1, i+1)
+			}
+
+			if cursor == "" {
+				state.PushNil()
+			} else {
+				state.PushString(cursor)
+			}
+
+			return 2
 		}
 	}
 
-	storeSet := func(store *kv.KV) func(*lua.State) int {
+	kvIncrement := func(store *kv.KV) func(*lua.State) int {
 		return func(state *lua.State) int {
 			key := state.ToString(state.GetTop() - 1)
-			value := state.ToString(state.GetTop())
+			delta := state.ToInteger(state.GetTop())
 
-			err := store.TransactionSet(key, value)
+			value, err := store.Increment(key, int64(delta))
 			if err != nil {
-				log.Error().Str("key", key).Str("value", value).Err(err).Msg("store.set failed")
+				log.Error().Str("key", key).Err(err).Msg("kv.incr failed")
+				state.PushNil()
+				state.PushString(err.Error())
+				return 2
 			}
 
-			return 0
+			state.PushInteger(value)
+
+			return 1
 		}
 	}
 
-	storeDelete := func(store *kv.KV) func(*lua.State) int {
+	kvCompareAndSwap := func(store *kv.KV) func(*lua.State) int {
 		return func(state *lua.State) int {
-			key := state.ToString(state.GetTop())
+			key := state.ToString(state.GetTop() - 2)
+			expected := state.ToString(state.GetTop() - 1)
+			new := state.ToString(state.GetTop())
 
-			err := store.TransactionDelete(key)
+			swapped, err := store.CompareAndSwap(key, expected, new)
 			if err != nil {
-				log.Error().Str("key", key).Err(err).Msg("store.delete failed")
+				log.Error().Str("key", key).Err(err).Msg("kv.cas failed")
+				state.PushBoolean(false)
+				state.PushString(err.Error())
+				return 2
 			}
 
-			return 0
+			state.PushBoolean(swapped)
+
+			return 1
 		}
 	}
 
+	// transactions are pushed to Lua as userdata and tracked so they're discarded if the state is freed mid-transaction
 	startTransaction := func(store *kv.KV) func(*lua.State) int {
 		return func(state *lua.State) int {
-			err := store.StartTransaction()
+			serial := state.ToBoolean(state.GetTop())
+
+			var txn *kv.Transaction
+			var err error
+			if serial {
+				txn, err = store.StartSerialTransaction()
+			} else {
+				txn, err = store.StartTransaction()
+			}
 			if err != nil {
-				log.Error().Err(err).Msg("kv.transaction failed to start")
+				log.Error().Err(err).Msg("kv transaction failed to start")
+				state.PushNil()
+				state.PushString(err.Error())
+				return 2
 			}
 
-			return 0
-		}
-	}
-
-	endTransaction := func(store *kv.KV) func(*lua.State) int {
-		return func(state *lua.State) int {
-			err := store.EndTransaction()
+			err = las.Update(state, func(as *las.AssociatedState) error {
+				as.TrackTransaction(txn)
+				return nil
+			})
 			if err != nil {
-				log.Error().Err(err).Msg("kv.transaction failed to commit")
+				txn.Discard()
+				state.PushNil()
+				state.PushString(err.Error())
+				return 2
 			}
 
-			return 0
+			state.PushGoStruct(txn)
+
+			return 1
 		}
 	}
 
-	startSerialTransaction := func(store *kv.KV) func(*lua.State) int {
-		return func(state *lua.State) int {
-			err := store.StartSerialTransaction()
-			if err != nil {
-				log.Error().Err(err).Msg("kv.serialTransaction failed to start")
-			}
+	state.Register("_kv_builtin", func(state *lua.State) int {
+		state.PushGoStruct(associatedStore(state.ToString(state.GetTop())))
+		return 1
+	})
 
-			return 0
+	state.Register("_kv_open", func(state *lua.State) int {
+		top := state.GetTop()
+		name := state.ToString(top - 4)
+		options := kv.StoreOptions{
+			Medium:     state.ToString(top - 3),
+			Path:       state.ToString(top - 2),
+			SyncWrites: state.ToBoolean(top - 1),
+			TTL:        time.Duration(state.ToNumber(top) * float64(time.Second)),
 		}
-	}
 
-	endSerialTransaction := func(store *kv.KV) func(*lua.State) int {
-		return func(state *lua.State) int {
-			err := store.EndSerialTransaction()
-			if err != nil {
-				log.Error().Err(err).Msg("kv.serialTransaction failed to commit")
+		store, err := kv.Open(name, options)
+		if err != nil {
+			log.Error().Str("store", name).Err(err).Msg("kv.open failed")
+			state.PushNil()
+			state.PushString(err.Error())
+			return 2
+		}
+
+		state.PushGoStruct(store)
+
+		return 1
+	})
+
+	state.Register("_kv_get", storeBinding(kvGet))
+	state.Register("_kv_list_keys", storeBinding(kvListKeys))
+	state.Register("_kv_list_pairs", storeBinding(kvListPairs))
+	state.Register("_kv_scan", storeBinding(kvScan))
+	state.Register("_kv_incr", storeBinding(kvIncrement))
+	state.Register("_kv_cas", storeBinding(kvCompareAndSwap))
+	state.Register("_kv_start_transaction", storeBinding(startTransaction))
+
+	// transactions know their store so their bindings don't need one
+	state.Register("_kv_transaction_get", func(state *lua.State) int {
+		txn, err := toTransaction(state, state.GetTop()-1)
+		key := state.ToString(state.GetTop())
+
+		value := ""
+		if err == nil {
+			value, err = txn.Get(key)
+		}
+		if err != nil {
+			log.Error().Str("key", key).Err(err).Msgf("store.get failed")
+			state.PushString("")
+			state.PushString(err.Error())
+			return 2
+		}
+
+		state.PushString(value)
+
+		return 1
+	})
+
+	state.Register("_kv_transaction_set", func(state *lua.State) int {
+		txn, err := toTransaction(state, state.GetTop()-3)
+		key := state.ToString(state.GetTop() - 2)
+		value := state.ToString(state.GetTop() - 1)
+		ttl := state.ToNumber(state.GetTop())
+
+		if err == nil {
+			if ttl > 0 {
+				err = txn.SetWithTTL(key, value, time.Duration(ttl*float64(time.Second)))
+			} else {
+				err = txn.Set(key, value)
 			}
+		}
+		if err != nil {
+			log.Error().Str("key", key).Str("value", value).Err(err).Msg("store.set failed")
+		}
 
-			return 0
+		return pushError(state, err)
+	})
+
+	state.Register("_kv_transaction_delete", func(state *lua.State) int {
+		txn, err := toTransaction(state, state.GetTop()-1)
+		key := state.ToString(state.GetTop())
+
+		if err == nil {
+			err = txn.Delete(key)
 		}
-	}
+		if err != nil {
+			log.Error().Str("key", key).Err(err).Msg("store.delete failed")
+		}
+
+		return pushError(state, err)
+	})
 
-	memoryStore := associatedStore("memory")
-
-	state.Register("_memory_get", kvGet(memoryStore))
-	state.Register("_memory_list_keys", kvListKeys(memoryStore))
-	state.Register("_memory_list_pairs", kvListPairs(memoryStore))
-	state.Register("_memory_transaction_get", storeGet(memoryStore))
-	state.Register("_memory_transaction_set", storeSet(memoryStore))
-	state.Register("_memory_transaction_delete", storeDelete(memoryStore))
-	state.Register("_start_memory_transaction", startTransaction(memoryStore))
-	state.Register("_end_memory_transaction", endTransaction(memoryStore))
-	state.Register("_start_memory_serial_transaction", startSerialTransaction(memoryStore))
-	state.Register("_end_memory_serial_transaction", endSerialTransaction(memoryStore))
-
-	diskStore := associatedStore("disk")
-
-	state.Register("_disk_get", kvGet(diskStore))
-	state.Register("_disk_list_keys", kvListKeys(diskStore))
-	state.Register("_disk_list_pairs", kvListPairs(diskStore))
-	state.Register("_disk_transaction_get", storeGet(diskStore))
-	state.Register("_disk_transaction_set", storeSet(diskStore))
-	state.Register("_disk_transaction_delete", storeDelete(diskStore))
-	state.Register("_start_disk_transaction", startTransaction(diskStore))
-	state.Register("_end_disk_transaction", endTransaction(diskStore))
-	state.Register("_start_disk_serial_transaction", startSerialTransaction(diskStore))
-	state.Register("_end_disk_serial_transaction", endSerialTransaction(diskStore))
+	// commit errors like conflicts are expected under contention so they're left to the Lua to handle
+	state.Register("_kv_transaction_commit", func(state *lua.State) int {
+		txn, err := toTransaction(state, state.GetTop())
+		if err == nil {
+			err = txn.Commit()
+			untrackTransaction(state, txn)
+		}
+
+		return pushError(state, err)
+	})
+
+	state.Register("_kv_transaction_discard", func(state *lua.State) int {
+		txn, err := toTransaction(state, state.GetTop())
+		if err == nil {
+			txn.Discard()
+			untrackTransaction(state, txn)
+		}
+
+		return 0
+	})
+
+	state.Register("_kv_backoff", func(state *lua.State) int {
+		kv.Backoff(state.ToInteger(state.GetTop()))
+		return 0
+	})
+
+	state.PushString(kv.ErrConflict.Error())
+	state.SetGlobal("_kv_err_conflict")
 
 	entropy := ulid.Monotonic(rand.New(rand.NewSource(time.Now().UnixNano())), 0)
 	state.Register("_generate_ulid", func(state *lua.State) int {
@@ -239,76 +376,49 @@ func LoadKV(state *lua.State) error {
 		return 1
 	})
 
-	kvTemplate := template.Must(template.New("").Parse(`
-		package.preload['heart.v1.kv.{{.medium}}'] = function()
-			local kv = {}
-			local store = {}
-
-			function kv.get(key)
-				return _{{.medium}}_get(key)
-			end
-
-			function kv.listKeys(prefix, limit)
-				return _{{.medium}}_list_keys(prefix, limit)
-			end
-
-			function kv.listPairs(prefix, limit)
-				return _{{.medium}}_list_pairs(prefix, limit)
-			end
-			
-			function kv.ulid()
-				return _generate_ulid()
-			end
-
-			function store.get(key)
-				return _{{.medium}}_transaction_get(key)
-			end
-
-			function store.set(key, value)
-				_{{.medium}}_transaction_set(key, value)
-			end
-
-			function store.delete(key)
-				_{{.medium}}_transaction_delete(key)
-			end
-
-			function kv.transaction(callback)
-				_start_{{.medium}}_transaction()
-				callback(store)
-				_end_{{.medium}}_transaction()
-			end
-
-			function kv.serialTransaction(callback)
-				_start_{{.medium}}_serial_transaction()
-				callback(store)
-				_end_{{.medium}}_serial_transaction()
-			end
-
-			return kv
-		end
-	`))
-
-	diskModule := new(bytes.Buffer)
-	err = kvTemplate.Execute(diskModule, map[string]string{"medium": "disk"})
-	if err != nil {
-		return err
-	}
+	return state.DoString(kvLua)
+}
 
-	err = state.DoString(diskModule.String())
+// push the error message or nil if there wasn't one
+func pushError(state *lua.State, err error) int {
 	if err != nil {
-		return err
+		state.PushString(err.Error())
+	} else {
+		state.PushNil()
 	}
 
-	memoryModule := new(bytes.Buffer)
-	err = kvTemplate.Execute(memoryModule, map[string]string{"medium": "memory"})
-	if err != nil {
-		return err
+	return 1
+}
+
+// storeBinding passes the *kv.KV pushed to Lua as userdata that's the first argument to the binding
+// the binding sees the rest of the arguments as if the store was never there
+func storeBinding(binding func(*kv.KV) func(*lua.State) int) lua.LuaGoFunction {
+	return func(state *lua.State) int {
+		store, ok := state.ToGoStruct(1).(*kv.KV)
+		if !ok {
+			log.Error().Msg("expected a kv store")
+			return 0
+		}
+		state.Remove(1)
+
+		return binding(store)(state)
 	}
+}
 
-	err = state.DoString(memoryModule.String())
-	if err != nil {
-		return err
+// get the *kv.Transaction pushed to Lua as userdata at the index or error
+func toTransaction(state *lua.State, index int) (*kv.Transaction, error) {
+	txn, ok := state.ToGoStruct(index).(*kv.Transaction)
+	if !ok {
+		return nil, fmt.Errorf("expected a kv transaction")
 	}
 
-	return nil
+	return txn, nil
+}
+
+// stop tracking the transaction once it's over
+func untrackTransaction(state *lua.State, txn *kv.Transaction) {
+	las.Update(state, func(as *las.AssociatedState) error {
+		as.UntrackTransaction(txn)
+		return nil
+	})
 }
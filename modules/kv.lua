@@ -0,0 +1,191 @@
+-- every store is passed to the Go bindings as userdata so any number of them can share the same API
+
+-- watchers added with kv.watch are started by the server once the app has loaded
+-- every state loads the same app in the same order so a watcher is at the same index in all of them
+_kv_watchers = {}
+
+-- a store wraps a single transaction so transactions can be nested or overlap
+-- store.set, store.delete and store.get's second return value are nil or an error message
+local function newStore(txn)
+  local store = {rolledBack = false}
+
+  function store.get(key)
+    return _kv_transaction_get(txn, key)
+  end
+
+  -- options.ttl is the number of seconds until the key expires, rounded up to the second
+  function store.set(key, value, options)
+    local ttl = 0
+    if options ~= nil and options.ttl ~= nil then
+      ttl = options.ttl
+    end
+
+    return _kv_transaction_set(txn, key, value, ttl)
+  end
+
+  function store.delete(key)
+    return _kv_transaction_delete(txn, key)
+  end
+
+  -- throws away the transaction's writes once the callback returns
+  function store.rollback()
+    store.rolledBack = true
+  end
+
+  return store
+end
+
+-- run the callback in a transaction and commit it when the callback returns
+-- the transaction is discarded if the callback raises an error, which is raised again
+-- returns true if it committed or false and the commit error, which is nil after a rollback
+local function run(db, serial, callback)
+  local txn, err = _kv_start_transaction(db, serial)
+  if txn == nil then
+    return false, err
+  end
+
+  local store = newStore(txn)
+  local success, callbackErr = unsafe_pcall(callback, store)
+  if not success then
+    _kv_transaction_discard(txn)
+    error(callbackErr, 0)
+  end
+
+  if store.rolledBack then
+    _kv_transaction_discard(txn)
+    return false
+  end
+
+  err = _kv_transaction_commit(txn)
+  if err ~= nil then
+    return false, err
+  end
+
+  return true
+end
+
+-- wrap the store in the KV API
+local function wrap(db)
+  local kv = {}
+
+  kv.ErrConflict = _kv_err_conflict
+
+  -- returns the value and the seconds it has left to live or nil if it never expires
+  -- or nil and an error message if the read failed
+  function kv.get(key)
+    return _kv_get(db, key)
+  end
+
+  function kv.listKeys(prefix, limit)
+    return _kv_list_keys(db, prefix, limit)
+  end
+
+  function kv.listPairs(prefix, limit)
+    return _kv_list_pairs(db, prefix, limit)
+  end
+
+  -- scans pairs in key order and returns a page of them plus a cursor for the next page or nil
+  -- options are prefix, start (inclusive), stop (exclusive), reverse, limit (default 100) and cursor
+  function kv.scan(options)
+    options = options or {}
+    return _kv_scan(
+      db,
+      options.prefix or '',
+      options.start or '',
+      options.stop or '',
+      options.reverse == true,
+      options.limit or 100,
+      options.cursor or ''
+    )
+  end
+
+  -- atomically adds delta (default 1) to the integer at the key and returns the new value
+  -- or nil and an error message if it failed, like when the key doesn't hold an integer
+  function kv.incr(key, delta)
+    return _kv_incr(db, key, delta or 1)
+  end
+
+  -- atomically sets the key to new if it holds expected and returns whether it did
+  -- an expected value of '' matches a missing key
+  -- it returns false and an error message if the swap failed rather than just didn't match
+  function kv.cas(key, expected, new)
+    return _kv_cas(db, key, expected, new)
+  end
+
+  function kv.ulid()
+    return _generate_ulid()
+  end
+
+  -- call the callback with the key and value of every write to keys with the prefix, in the order they're committed
+  -- deleted keys have a value of ''
+  -- callbacks run in the background on pooled state so watchers have to be added when the app loads, not in handlers
+  -- options is optional and can set a timeout in seconds that overrides the global REQUEST_TIMEOUT the callback runs under otherwise
+  -- setting it turns LuaJIT's compiler off for the state that runs the callback so the timeout can always interrupt it
+  function kv.watch(prefix, callback, options)
+    table.insert(_kv_watchers, {db = db, prefix = prefix, callback = callback, options = options or {}})
+  end
+
+  function kv.transaction(callback)
+    return run(db, false, callback)
+  end
+
+  -- serial transactions on the same store wait on each other so they can't be nested
+  function kv.serialTransaction(callback)
+    return run(db, true, callback)
+  end
+
+  -- run the callback in a transaction up to attempts times for as long as committing it conflicts
+  -- the callback should read everything it depends on through the store so every attempt sees fresh values
+  function kv.retry(attempts, callback)
+    local committed, err
+    for attempt = 0, attempts - 1 do
+      committed, err = kv.transaction(callback)
+      if err ~= kv.ErrConflict then
+        return committed, err
+      end
+
+      _kv_backoff(attempt)
+    end
+
+    return committed, err
+  end
+
+  return kv
+end
+
+package.preload['heart.v1.kv'] = function()
+  local kv = {}
+
+  -- open the named store, each one is its own keyspace
+  -- options are medium ('memory' or 'disk', default 'memory'), path, syncWrites (default true)
+  -- and ttl which is the number of seconds every write expires after unless it's given its own
+  -- names can only have letters, digits, _ and -
+  -- a store can be opened any number of times with the same options but opening it with different ones is an error
+  -- that includes the built-in 'memory' and 'disk' stores
+  function kv.open(name, options)
+    options = options or {}
+
+    local db, err = _kv_open(
+      name,
+      options.medium or 'memory',
+      options.path or '',
+      options.syncWrites ~= false,
+      options.ttl or 0
+    )
+    if db == nil then
+      error(err, 2)
+    end
+
+    return wrap(db)
+  end
+
+  return kv
+end
+
+package.preload['heart.v1.kv.memory'] = function()
+  return wrap(_kv_builtin('memory'))
+end
+
+package.preload['heart.v1.kv.disk'] = function()
+  return wrap(_kv_builtin('disk'))
+end
@@ -0,0 +1,89 @@
+package modules
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/sosodev/heart/las"
+	"github.com/sosodev/heart/pubsub"
+
+	_ "embed"
+)
+
+var (
+	//go:embed pubsub.lua
+	pubsubLua string
+)
+
+// LoadPubSub creates a module for broadcasting messages between handlers running on different state
+func LoadPubSub(state *lua.State) error {
+	state.Register("_pubsub_publish", func(state *lua.State) int {
+		topic := state.ToString(1)
+		message := state.ToString(2)
+
+		state.PushInteger(int64(pubsub.Default.Publish(topic, message)))
+		return 1
+	})
+
+	state.Register("_pubsub_subscribe", func(state *lua.State) int {
+		subscription := pubsub.Default.Subscribe(state.ToString(1))
+
+		// the subscription is tracked so it's closed even if the handler is aborted before it can close it
+		las.Update(state, func(as *las.AssociatedState) error {
+			as.TrackSubscription(subscription)
+			return nil
+		})
+
+		state.PushGoStruct(subscription)
+		return 1
+	})
+
+	state.Register("_pubsub_receive", func(state *lua.State) int {
+		subscription, err := toSubscription(state, 1)
+		timeout := state.ToNumber(2)
+
+		message := ""
+		if err == nil {
+			message, err = subscription.Receive(time.Duration(timeout * float64(time.Second)))
+		}
+		if err != nil {
+			state.PushNil()
+			if err == pubsub.ErrTimeout {
+				state.PushString("timeout")
+			} else {
+				state.PushString("closed")
+			}
+			return 2
+		}
+
+		state.PushString(message)
+		return 1
+	})
+
+	state.Register("_pubsub_close", func(state *lua.State) int {
+		subscription, err := toSubscription(state, 1)
+		if err != nil {
+			return 0
+		}
+
+		subscription.Close()
+		las.Update(state, func(as *las.AssociatedState) error {
+			as.UntrackSubscription(subscription)
+			return nil
+		})
+
+		return 0
+	})
+
+	return state.DoString(pubsubLua)
+}
+
+func toSubscription(state *lua.State, index int) (*pubsub.Subscription, error) {
+	subscription, ok := state.ToGoStruct(index).(*pubsub.Subscription)
+	if !ok {
+		return nil, fmt.Errorf("expected a pubsub subscription")
+	}
+
+	return subscription, nil
+}
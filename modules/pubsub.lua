@@ -0,0 +1,81 @@
+package.preload['heart.v1.pubsub'] = function()
+  local pubsub = {}
+  local json = require('heart.v1.json')
+
+  -- how many seconds a receive waits at a time
+  local receiveSlice = 0.1
+
+  -- publish the message to every subscriber of the topic, on any state, and return how many got it
+  -- tables are encoded as JSON and subscribers that have fallen too far behind miss the message
+  function pubsub.publish(topic, message)
+    if type(message) == 'table' then
+      message = json.encode(message)
+    end
+
+    return _pubsub_publish(topic, tostring(message))
+  end
+
+  -- subscribe to the messages published to the topic from now on
+  --
+  -- with a callback it blocks calling the callback with every message until the callback returns false,
+  -- raises an error or the server shuts down which makes it a good fit for websocket and ctx.sse handlers
+  -- in a plain handler the request timeout still applies
+  --
+  -- without a callback it returns a subscription with receive(timeout) and close()
+  -- receive waits up to timeout seconds, or forever without one, and returns the message
+  -- or nil and 'timeout' or 'closed'
+  function pubsub.subscribe(topic, callback)
+    local sub = _pubsub_subscribe(topic)
+    local subscription = {}
+
+    function subscription.receive(timeout)
+      local forever = timeout == nil or timeout <= 0
+      local remaining = timeout
+
+      -- the wait is cut into slices that come back to Lua in between
+      -- so the instruction hook that enforces the request timeout can abort a handler stuck waiting
+      while true do
+        local wait = receiveSlice
+        if not forever and remaining < wait then
+          wait = remaining
+        end
+
+        local message, err = _pubsub_receive(sub, wait)
+        if err ~= 'timeout' then
+          return message, err
+        end
+
+        if not forever then
+          remaining = remaining - wait
+          if remaining <= 0 then
+            return nil, 'timeout'
+          end
+        end
+      end
+    end
+
+    function subscription.close()
+      _pubsub_close(sub)
+    end
+
+    if callback == nil then
+      return subscription
+    end
+
+    local success, err = unsafe_pcall(function()
+      while true do
+        local message = subscription.receive()
+        if message == nil or callback(message) == false then
+          return
+        end
+      end
+    end)
+
+    subscription.close()
+    if not success then
+      error(err, 0)
+    end
+  end
+
+  return pubsub
+end
@@ -0,0 +1,101 @@
+package modules
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/rs/zerolog/log"
+	"github.com/sosodev/heart/config"
+	"github.com/sosodev/heart/secure"
+)
+
+// errNoSecretKey is raised in Lua by the APIs that need the secret key when it isn't set in production
+var errNoSecretKey = errors.New("Env variable SECRET_KEY has to be set in production to use sessions, signed cookies or encrypted cookies")
+
+var (
+	secretOnce sync.Once
+	secret     string
+	secretErr  error
+
+	// signed and encrypted cookies have their own keys so one can't be passed off as the other
+	cookieSigner  = &lazySigner{purpose: "cookie signing"}
+	cookieCipher  = &lazyCipher{purpose: "cookie encryption"}
+	sessionSigner = &lazySigner{purpose: "session"}
+)
+
+// get the SECRET_KEY config or a random secret for the life of the process if it isn't set
+// sessions, signed cookies and encrypted cookies all key off of it
+// in production it has to be set since every instance of the app needs the same one
+// it's only read when one of them is first used so apps that don't use them don't need it
+func secretKey() (string, error) {
+	secretOnce.Do(func() {
+		appConfig := config.NewConfig()
+		secret = appConfig.SecretKey
+		if secret != "" {
+			return
+		}
+
+		if appConfig.Production {
+			log.Error().Msg("Env variable SECRET_KEY has to be set in production to use sessions, signed cookies or encrypted cookies")
+			secretErr = errNoSecretKey
+			return
+		}
+
+		log.Warn().Msg("SECRET_KEY isn't set so signed and encrypted values won't survive a restart")
+
+		secret, secretErr = secure.Token(32)
+	})
+
+	return secret, secretErr
+}
+
+// lazySigner derives its signer from the secret key the first time it's used
+type lazySigner struct {
+	purpose string
+	once    sync.Once
+	signer  *secure.Signer
+	err     error
+}
+
+// get the signer or raise a Lua error when there's no secret key to derive it from
+func (l *lazySigner) get(state *lua.State) *secure.Signer {
+	l.once.Do(func() {
+		var key string
+		key, l.err = secretKey()
+		if l.err == nil {
+			l.signer = secure.NewSigner(secure.Key(key, l.purpose))
+		}
+	})
+
+	if l.err != nil {
+		state.RaiseError(l.err.Error())
+	}
+
+	return l.signer
+}
+
+// lazyCipher derives its cipher from the secret key the first time it's used
+type lazyCipher struct {
+	purpose string
+	once    sync.Once
+	cipher  *secure.Cipher
+	err     error
+}
+
+// get the cipher or raise a Lua error when there's no secret key to derive it from
+func (l *lazyCipher) get(state *lua.State) *secure.Cipher {
+	l.once.Do(func() {
+		var key string
+		key, l.err = secretKey()
+		if l.err == nil {
+			l.cipher, l.err = secure.NewCipher(secure.Key(key, l.purpose))
+		}
+	})
+
+	if l.err != nil {
+		state.RaiseError(l.err.Error())
+	}
+
+	return l.cipher
+}
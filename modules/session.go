@@ -0,0 +1,72 @@
+package modules
+
+import (
+	"github.com/aarzilli/golua/lua"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/sosodev/heart/secure"
+	"github.com/valyala/fasthttp"
+
+	_ "embed"
+)
+
+var (
+	//go:embed session.lua
+	sessionLua string
+)
+
+// the bytes of randomness in a session id
+const sessionIDSize = 32
+
+// LoadSession creates a module for sessions whose ids are kept in a signed cookie
+// signing raises an error when there's no secret key to sign with
+func LoadSession(state *lua.State) error {
+	// get the session id from the cookie or nil if there isn't one or it was tampered with
+	state.Register("_session_cookie", func(state *lua.State) int {
+		id, ok := sessionSigner.get(state).Verify(state.ToString(1), requestCtx(state).Cookies(state.ToString(1)))
+		if !ok {
+			state.PushNil()
+			return 1
+		}
+
+		state.PushString(id)
+		return 1
+	})
+
+	// set the cookie to the signed session id or clear it when the id is nil
+	state.Register("_set_session_cookie", func(state *lua.State) int {
+		cookie := &fiber.Cookie{
+			Name:     state.ToString(1),
+			Path:     "/",
+			MaxAge:   state.ToInteger(3),
+			Secure:   state.ToBoolean(4),
+			HTTPOnly: true,
+			SameSite: "Lax",
+		}
+
+		if state.IsNil(2) {
+			cookie.MaxAge = 0
+			cookie.Expires = fasthttp.CookieExpireDelete
+		} else {
+			cookie.Value = sessionSigner.get(state).Sign(cookie.Name, state.ToString(2))
+		}
+
+		requestCtx(state).Cookie(cookie)
+		return 0
+	})
+
+	state.Register("_session_id", func(state *lua.State) int {
+		id, err := secure.Token(sessionIDSize)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to generate session id")
+			state.PushNil()
+			state.PushString(err.Error())
+			return 2
+		}
+
+		state.PushString(id)
+		return 1
+	})
+
+	return state.DoString(sessionLua)
+}
@@ -0,0 +1,127 @@
+package.preload['heart.v1.session'] = function()
+  local session = {}
+  local json = require('heart.v1.json')
+
+  -- create middleware that gives every request a ctx.session with get, set, destroy and regenerate
+  --
+  -- options are store ('memory' or 'disk', default 'memory'), cookie (the cookie's name, default 'heart_session'),
+  -- ttl (the seconds a session lives after it was last used, default 86400) and secure (send the cookie over HTTPS only)
+  --
+  -- the cookie only holds the signed session id and the data is kept in the store as JSON
+  -- a session isn't saved until something is set in it so visitors don't each get one
+  -- the cookie is signed with the SECRET_KEY so requests through the middleware raise an error in production when it isn't set
+  function session.middleware(options)
+    options = options or {}
+    local db = require('heart.v1.kv.' .. (options.store or 'memory'))
+    local cookie = options.cookie or 'heart_session'
+    local ttl = options.ttl or 86400
+    local secure = options.secure == true
+
+    local function key(id)
+      return 'session:' .. id
+    end
+
+    return function(ctx)
+      local id = _session_cookie(cookie)
+      local data = {}
+      local remaining = nil
+      if id ~= nil then
+        local value, left = db.get(key(id))
+        if value == nil or value == '' then
+          id = nil
+        else
+          data = json.decode(value)
+          remaining = left
+        end
+      end
+
+      local changed = false
+      local destroyed = false
+      local staleID = nil
+
+      ctx.session = {}
+
+      function ctx.session.get(name)
+        return data[name]
+      end
+
+      function ctx.session.set(name, value)
+        data[name] = value
+        changed = true
+        destroyed = false
+      end
+
+      -- throw the session away and clear the cookie
+      function ctx.session.destroy()
+        data = {}
+        changed = false
+        destroyed = true
+      end
+
+      -- move the session to a new id, which should be done whenever the user logs in or out
+      function ctx.session.regenerate()
+        if id ~= nil and staleID == nil then
+          staleID = id
+        end
+
+        local newID, err = _session_id()
+        if newID == nil then
+          error(err, 2)
+        end
+
+        id = newID
+        changed = true
+        destroyed = false
+      end
+
+      local body, status, headers = ctx.next()
+      ctx.session = nil
+
+      if staleID ~= nil then
+        db.transaction(function(store)
+          store.delete(key(staleID))
+        end)
+      end
+
+      if destroyed then
+        if id ~= nil then
+          db.transaction(function(store)
+            store.delete(key(id))
+          end)
+          _set_session_cookie(cookie, nil, 0, secure)
+        end
+
+        return body, status, headers
+      end
+
+      -- sliding expiry only rewrites an untouched session once half of its ttl has passed
+      if not changed and (id == nil or remaining == nil or remaining > ttl / 2) then
+        return body, status, headers
+      end
+
+      if id == nil then
+        local err
+        id, err = _session_id()
+        if id == nil then
+          error(err, 0)
+        end
+      end
+
+      local committed, err = db.transaction(function(store)
+        local setErr = store.set(key(id), json.encode(data), {ttl = ttl})
+        if setErr ~= nil then
+          error(setErr, 0)
+        end
+      end)
+      if not committed then
+        error('failed to save session: ' .. tostring(err), 0)
+      end
+
+      _set_session_cookie(cookie, id, ttl, secure)
+
+      return body, status, headers
+    end
+  end
+
+  return session
+end
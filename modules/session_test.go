@@ -0,0 +1,190 @@
+package modules_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sosodev/heart/kv"
+	"github.com/sosodev/heart/modules"
+)
+
+// newSessionApp serves the session routes with the middleware configured by options, a Lua table constructor
+func newSessionApp(t *testing.T, options string) *fiber.App {
+	os.Setenv("DB_PATH", t.TempDir())
+	t.Cleanup(func() {
+		os.Unsetenv("DB_PATH")
+	})
+
+	loaders := []func(*lua.State) error{modules.LoadJSON, modules.LoadContext, modules.LoadKV, modules.LoadSession, modules.LoadHeart}
+	app := newLuaApp(t, loaders, `
+		local app = require('heart.v1')
+		local session = require('heart.v1.session')
+
+		app.use(session.middleware(`+options+`))
+
+		app.get('/set', function(ctx)
+			ctx.session.set('user', 'ada')
+			return 'set'
+		end)
+
+		app.get('/get', function(ctx)
+			return tostring(ctx.session.get('user'))
+		end)
+
+		app.get('/regenerate', function(ctx)
+			ctx.session.regenerate()
+			return tostring(ctx.session.get('user'))
+		end)
+
+		app.get('/destroy', function(ctx)
+			ctx.session.destroy()
+			return 'destroyed'
+		end)
+	`, "/set", "/get", "/regenerate", "/destroy")
+
+	t.Cleanup(kv.CloseStores)
+
+	return app
+}
+
+// request the path with the session cookie if there is one
+// returns the body and the session cookie the response set or nil
+func sessionRequest(t *testing.T, app *fiber.App, path string, cookie *http.Cookie) (string, *http.Cookie) {
+	req := httptest.NewRequest("GET", path, nil)
+	if cookie != nil {
+		req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("GET %s failed: %s", path, err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the body of GET %s: %s", path, err)
+	}
+
+	for _, set := range resp.Cookies() {
+		if set.Name == "heart_session" {
+			return string(body), set
+		}
+	}
+
+	return string(body), nil
+}
+
+func TestSessionCookie(t *testing.T) {
+	app := newSessionApp(t, `{ttl = 100}`)
+
+	// nothing is saved for a visitor that doesn't set anything
+	body, cookie := sessionRequest(t, app, "/get", nil)
+	if body != "nil" || cookie != nil {
+		t.Errorf("an empty session shouldn't be issued a cookie: %q %+v", body, cookie)
+	}
+
+	_, cookie = sessionRequest(t, app, "/set", nil)
+	if cookie == nil {
+		t.Fatal("setting a value should issue a session cookie")
+	}
+	if cookie.MaxAge != 100 || !cookie.HttpOnly || cookie.Path != "/" || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("the session cookie didn't get its options: %+v", cookie)
+	}
+
+	// a fresh session isn't rewritten on every request
+	body, refreshed := sessionRequest(t, app, "/get", cookie)
+	if body != "ada" {
+		t.Errorf("expected the session to hold the user but got %q", body)
+	}
+	if refreshed != nil {
+		t.Errorf("a fresh session shouldn't be rewritten: %+v", refreshed)
+	}
+
+	// the id is signed so changing it drops the session
+	first := "a"
+	if cookie.Value[:1] == first {
+		first = "b"
+	}
+	tampered := &http.Cookie{Name: cookie.Name, Value: first + cookie.Value[1:]}
+	body, _ = sessionRequest(t, app, "/get", tampered)
+	if body != "nil" {
+		t.Errorf("a tampered cookie should drop the session but got %q", body)
+	}
+}
+
+func TestSessionSlidingExpiry(t *testing.T) {
+	app := newSessionApp(t, `{ttl = 2}`)
+
+	_, cookie := sessionRequest(t, app, "/set", nil)
+	if cookie == nil {
+		t.Fatal("setting a value should issue a session cookie")
+	}
+
+	// past half of the ttl the session is saved again so it keeps living while it's used
+	time.Sleep(1500 * time.Millisecond)
+	body, refreshed := sessionRequest(t, app, "/get", cookie)
+	if body != "ada" {
+		t.Fatalf("expected the session to hold the user but got %q", body)
+	}
+	if refreshed == nil || refreshed.Value != cookie.Value || refreshed.MaxAge != 2 {
+		t.Fatalf("the session should be refreshed under the same id: %+v", refreshed)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	body, _ = sessionRequest(t, app, "/get", cookie)
+	if body != "ada" {
+		t.Errorf("a refreshed session shouldn't expire from its first ttl but got %q", body)
+	}
+}
+
+func TestSessionRegenerate(t *testing.T) {
+	app := newSessionApp(t, `{ttl = 100}`)
+
+	_, cookie := sessionRequest(t, app, "/set", nil)
+	if cookie == nil {
+		t.Fatal("setting a value should issue a session cookie")
+	}
+
+	body, regenerated := sessionRequest(t, app, "/regenerate", cookie)
+	if body != "ada" {
+		t.Errorf("regenerating should keep the data but got %q", body)
+	}
+	if regenerated == nil || regenerated.Value == cookie.Value {
+		t.Fatalf("regenerating should issue a new id: %+v", regenerated)
+	}
+
+	body, _ = sessionRequest(t, app, "/get", regenerated)
+	if body != "ada" {
+		t.Errorf("the new id should hold the data but got %q", body)
+	}
+
+	body, _ = sessionRequest(t, app, "/get", cookie)
+	if body != "nil" {
+		t.Errorf("the old id should be gone but got %q", body)
+	}
+}
+
+func TestSessionDestroy(t *testing.T) {
+	app := newSessionApp(t, `{ttl = 100}`)
+
+	_, cookie := sessionRequest(t, app, "/set", nil)
+	if cookie == nil {
+		t.Fatal("setting a value should issue a session cookie")
+	}
+
+	_, cleared := sessionRequest(t, app, "/destroy", cookie)
+	if cleared == nil || cleared.Value != "" {
+		t.Errorf("destroying the session should clear the cookie: %+v", cleared)
+	}
+
+	body, _ := sessionRequest(t, app, "/get", cookie)
+	if body != "nil" {
+		t.Errorf("the destroyed session should be gone but got %q", body)
+	}
+}
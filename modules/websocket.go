@@ -0,0 +1,154 @@
+package modules
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/gofiber/websocket/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/sosodev/heart/las"
+
+	_ "embed"
+)
+
+var (
+	//go:embed websocket.lua
+	websocketLua string
+)
+
+// the *fiber.Ctx of the upgrade request is gone by the time the connection is handed to Lua
+// so whatever ws.ctx needs that the websocket.Conn doesn't keep is copied into its locals under this key
+const upgradeRequestKey = "heart.upgrade"
+
+// how long ws.close waits to write the close message
+const closeWriteTimeout = time.Second
+
+// upgradeRequest is the part of the upgrade request that outlives its *fiber.Ctx
+type upgradeRequest struct {
+	path    string
+	ip      string
+	headers map[string]string
+}
+
+// CaptureUpgradeRequest copies what ws.ctx needs out of the request before it's upgraded
+func CaptureUpgradeRequest(ctx *fiber.Ctx) {
+	request := &upgradeRequest{
+		path:    utils.CopyString(ctx.Path()),
+		ip:      ctx.IP(),
+		headers: make(map[string]string),
+	}
+
+	ctx.Request().Header.VisitAll(func(key, value []byte) {
+		request.headers[strings.ToLower(string(key))] = string(value)
+	})
+
+	ctx.Locals(upgradeRequestKey, request)
+}
+
+// LoadWebsocket creates a module for the connection of a websocket route
+// The connection is associated with the state when it's upgraded
+func LoadWebsocket(state *lua.State) error {
+	conn := func(state *lua.State) *websocket.Conn {
+		as, ok := las.Get(state)
+		if !ok || as.Websocket == nil {
+			state.RaiseError("ws can only be used in a websocket handler")
+		}
+
+		return as.Websocket
+	}
+
+	request := func(state *lua.State) *upgradeRequest {
+		request, ok := conn(state).Locals(upgradeRequestKey).(*upgradeRequest)
+		if !ok {
+			return &upgradeRequest{headers: map[string]string{}}
+		}
+
+		return request
+	}
+
+	state.Register("_ws_send", func(state *lua.State) int {
+		message := state.ToBytes(1)
+		messageType := websocket.TextMessage
+		if state.ToBoolean(2) {
+			messageType = websocket.BinaryMessage
+		}
+
+		err := conn(state).WriteMessage(messageType, message)
+		if err != nil {
+			state.PushString(err.Error())
+			return 1
+		}
+
+		return 0
+	})
+
+	state.Register("_ws_receive", func(state *lua.State) int {
+		messageType, message, err := conn(state).ReadMessage()
+		if err != nil {
+			state.PushNil()
+			state.PushString(err.Error())
+			return 2
+		}
+
+		pushBytes(state, message)
+		if messageType == websocket.BinaryMessage {
+			state.PushString("binary")
+		} else {
+			state.PushString("text")
+		}
+
+		return 2
+	})
+
+	state.Register("_ws_close", func(state *lua.State) int {
+		code := state.ToInteger(1)
+		reason := state.ToString(2)
+
+		err := conn(state).WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(closeWriteTimeout))
+		if err != nil {
+			log.Debug().Err(err).Msg("Failed to write websocket close message")
+		}
+
+		err = conn(state).Close()
+		if err != nil {
+			log.Debug().Err(err).Msg("Failed to close websocket")
+		}
+
+		return 0
+	})
+
+	state.Register("_ws_path_param", func(state *lua.State) int {
+		state.PushString(conn(state).Params(state.ToString(1)))
+		return 1
+	})
+
+	state.Register("_ws_query_param", func(state *lua.State) int {
+		state.PushString(conn(state).Query(state.ToString(1)))
+		return 1
+	})
+
+	state.Register("_ws_cookie", func(state *lua.State) int {
+		state.PushString(conn(state).Cookies(state.ToString(1)))
+		return 1
+	})
+
+	state.Register("_ws_header", func(state *lua.State) int {
+		state.PushString(request(state).headers[strings.ToLower(state.ToString(1))])
+		return 1
+	})
+
+	state.Register("_ws_path", func(state *lua.State) int {
+		state.PushString(request(state).path)
+		return 1
+	})
+
+	state.Register("_ws_ip", func(state *lua.State) int {
+		state.PushString(request(state).ip)
+		return 1
+	})
+
+	return state.DoString(websocketLua)
+}
@@ -0,0 +1,60 @@
+package.preload['heart.v1.websocket'] = function()
+  local ws = {ctx = {}}
+  local json = require('heart.v1.json')
+
+  -- send a message to the client
+  -- tables are encoded as JSON and kind is 'text' (the default) or 'binary'
+  -- returns nil or an error message if the connection is gone
+  function ws.send(message, kind)
+    if type(message) == 'table' then
+      message = json.encode(message)
+    end
+
+    return _ws_send(message, kind == 'binary')
+  end
+
+  -- wait for the next message from the client
+  -- returns the message and its kind ('text' or 'binary') or nil and an error message once the connection is closed
+  function ws.receive()
+    return _ws_receive()
+  end
+
+  -- close the connection with the given close code (default 1000) and reason
+  function ws.close(code, reason)
+    _ws_close(code or 1000, reason or '')
+  end
+
+  -- the upgrade request is read only since the response was the upgrade itself
+
+  -- get the value of the given path param by key
+  function ws.ctx.pathParam(key)
+    return _ws_path_param(key)
+  end
+
+  -- get the value of a query param by key
+  function ws.ctx.queryParam(key)
+    return _ws_query_param(key)
+  end
+
+  -- get a cookie by key
+  function ws.ctx.cookies(key)
+    return _ws_cookie(key)
+  end
+
+  -- get a header by key
+  function ws.ctx.headers(key)
+    return _ws_header(key)
+  end
+
+  -- get the request path
+  function ws.ctx.path()
+    return _ws_path()
+  end
+
+  -- get the client's IP address
+  function ws.ctx.ip()
+    return _ws_ip()
+  end
+
+  return ws
+end
@@ -1,66 +1,113 @@
 package pool
 
 import (
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/aarzilli/golua/lua"
 	"github.com/rs/zerolog/log"
 	"github.com/sosodev/heart/config"
 	"github.com/sosodev/heart/las"
+	"github.com/sosodev/heart/metrics"
 	"github.com/valyala/fastrand"
 )
 
-// TODO: consider ways to make the pool self-optimizing
-// an ideal pool would be able to provision just enough state for peak demand
-// without taking the performance penatly of doing it JIT
+// how often the pool checks if it should pre-warm or reap state
+const maintenanceInterval = time.Second
+
+// the pool pre-warms more state in the background once this fraction of it is in use
+const highUtilization = 0.75
+
+var (
+	// ErrExhausted is returned by Take when the pool is at its max size and no state was returned in time
+	ErrExhausted = errors.New("every lua state in the pool is in use")
+	// ErrClosed is returned by Take once the pool has been closed
+	ErrClosed = errors.New("the pool has been closed")
+	// ErrDetachedExhausted is returned by NewDetached when the max number of detached states are open
+	ErrDetachedExhausted = errors.New("every detached lua state is in use")
+
+	takeWait        = metrics.NewHistogram("heart_pool_take_wait_seconds", "Time spent waiting to take lua state from the pool", metrics.DefaultBuckets)
+	statesCreated   = metrics.NewCounter("heart_pool_states_created_total", "Lua states created by the pool")
+	statesRecycled  = metrics.NewCounter("heart_pool_states_recycled_total", "Lua states recycled after being taken too many times")
+	statesDiscarded = metrics.NewCounter("heart_pool_states_discarded_total", "Lua states discarded because they may be corrupted")
+	statesReaped    = metrics.NewCounter("heart_pool_states_reaped_total", "Lua states closed after sitting idle")
+)
+
+// Stats is a snapshot of how the pool's state is being used
+type Stats struct {
+	Size     int
+	InUse    int
+	Idle     int
+	Waiting  int
+	Detached int
+}
 
 // Pool is a pool of *lua.State
+// It grows on demand up to its max size and shrinks back to its min size when state sits idle
 type Pool struct {
 	config      *config.Config
-	stack       []*lua.State
-	top         int
+	stack       []idleState
 	lock        sync.Mutex
 	initializer func(*lua.State) error
+	size        int
+	inUse       int
+	waiters     []chan *lua.State
+	detached    int
+	closed      bool
+	drained     *sync.Cond
+	stop        chan struct{}
+}
+
+// idleState is a *lua.State sitting in the pool and when it was put there
+type idleState struct {
+	state *lua.State
+	since time.Time
 }
 
 // New gets you a *Pool of fully initialized *lua.State
 // Needs the initial size of the pool and an initializer function
 // The initializer will be reused later when the pool grows to meet peak demand
 func New(config *config.Config, initializer func(*lua.State) error) (*Pool, error) {
+	initialSize := config.InitialPoolSize
+	if initialSize < config.PoolMinSize {
+		initialSize = config.PoolMinSize
+	}
+	if config.PoolMaxSize > 0 && initialSize > config.PoolMaxSize {
+		initialSize = config.PoolMaxSize
+	}
+
 	pool := &Pool{
 		config:      config,
-		stack:       make([]*lua.State, config.InitialPoolSize),
-		top:         config.InitialPoolSize - 1,
+		stack:       make([]idleState, 0, initialSize),
 		initializer: initializer,
+		size:        initialSize,
+		stop:        make(chan struct{}),
 	}
+	pool.drained = sync.NewCond(&pool.lock)
 
-	for i := 0; i < config.InitialPoolSize; i++ {
-		state := lua.NewState()
-		pool.stack[i] = state
-		err := pool.initializer(state)
+	for i := 0; i < initialSize; i++ {
+		state, err := pool.newState()
 		if err != nil {
+			// the pool is thrown away so the state it already made has to be closed with it
+			pool.Cleanup()
 			return nil, err
 		}
+		pool.stack = append(pool.stack, idleState{state: state, since: time.Now()})
 	}
 
+	go pool.maintain()
+
 	return pool, nil
 }
 
 func (p *Pool) empty() bool {
-	return p.top == -1
+	return len(p.stack) == 0
 }
 
-func (p *Pool) size() int {
-	return p.top + 1
-}
-
-func (p *Pool) peek() *lua.State {
-	if p.empty() {
-		return nil
-	}
-
-	return p.stack[p.top]
+func (p *Pool) full() bool {
+	return p.config.PoolMaxSize > 0 && p.size >= p.config.PoolMaxSize
 }
 
 func (p *Pool) randomTake() *lua.State {
@@ -68,23 +115,33 @@ func (p *Pool) randomTake() *lua.State {
 		panic("interally tried to take from empty pool")
 	}
 
-	var state *lua.State
-	if p.size() == 1 {
-		state = p.peek()
-		p.stack = p.stack[:p.top]
-		p.top--
-		return state
+	last := len(p.stack) - 1
+	randIndex := last
+	if last > 0 {
+		randIndex = int(fastrand.Uint32n(uint32(len(p.stack))))
 	}
 
-	randIndex := fastrand.Uint32n(uint32(p.size()))
-	state = p.stack[randIndex]
-	p.stack[randIndex] = p.stack[p.top]
-	p.stack = p.stack[:p.top]
-	p.top--
+	state := p.stack[randIndex].state
+	p.stack[randIndex] = p.stack[last]
+	p.stack = p.stack[:last]
 
 	return state
 }
 
+// put the state back in the pool or hand it straight to the longest waiting Take
+// the lock must be held
+func (p *Pool) put(state *lua.State) {
+	if len(p.waiters) > 0 {
+		waiter := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.inUse++
+		waiter <- state
+		return
+	}
+
+	p.stack = append(p.stack, idleState{state: state, since: time.Now()})
+}
+
 func (p *Pool) newState() (*lua.State, error) {
 	state := lua.NewState()
 	if state == nil {
@@ -93,14 +150,23 @@ func (p *Pool) newState() (*lua.State, error) {
 
 	err := p.initializer(state)
 	if err != nil {
+		closeState(state)
 		return nil, err
 	}
+	statesCreated.Inc()
 
 	return state, nil
 }
 
+// closeState and free its associated state
+func closeState(state *lua.State) {
+	state.Close()
+	las.Free(state)
+}
+
 // Take a *lua.State from the pool
-// Provisions and initializes a new one if the pool is empty
+// Provisions and initializes a new one if the pool is empty and below its max size
+// Otherwise it waits in line for state to be returned and gives up with ErrExhausted
 func (p *Pool) Take() (state *lua.State, err error) {
 	updateStateTakeCount := func() {
 		as, ok := las.Get(state)
@@ -109,18 +175,82 @@ func (p *Pool) Take() (state *lua.State, err error) {
 		}
 	}
 
+	// timing every take isn't free so it's skipped when nothing is scraping it
+	if p.config.Metrics {
+		start := time.Now()
+		defer func() {
+			takeWait.Observe(time.Since(start).Seconds())
+		}()
+	}
+
 	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil, ErrClosed
+	}
+
 	if !p.empty() {
 		state = p.randomTake()
+		p.inUse++
+		p.lock.Unlock()
+		updateStateTakeCount()
+		return state, nil
+	}
+
+	if !p.full() {
+		p.size++
+		p.inUse++
 		p.lock.Unlock()
+
+		state, err = p.newState()
+		if err != nil {
+			p.lock.Lock()
+			p.size--
+			p.inUse--
+			p.drained.Broadcast()
+			p.lock.Unlock()
+			return nil, err
+		}
 		updateStateTakeCount()
 		return state, nil
 	}
+
+	if len(p.waiters) >= p.config.PoolMaxWaiters {
+		p.lock.Unlock()
+		return nil, ErrExhausted
+	}
+
+	waiter := make(chan *lua.State, 1)
+	p.waiters = append(p.waiters, waiter)
 	p.lock.Unlock()
 
-	state, err = p.newState()
-	if err != nil {
-		return nil, err
+	timer := time.NewTimer(p.config.PoolWaitTimeout)
+	defer timer.Stop()
+
+	select {
+	case state, ok := <-waiter:
+		if !ok {
+			return nil, ErrClosed
+		}
+		updateStateTakeCount()
+		return state, nil
+	case <-timer.C:
+	}
+
+	p.lock.Lock()
+	for i, w := range p.waiters {
+		if w == waiter {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			p.lock.Unlock()
+			return nil, ErrExhausted
+		}
+	}
+	p.lock.Unlock()
+
+	// state was handed over right as the wait timed out
+	state, ok := <-waiter
+	if !ok {
+		return nil, ErrClosed
 	}
 	updateStateTakeCount()
 	return state, nil
@@ -133,35 +263,270 @@ func (p *Pool) Return(state *lua.State) {
 		log.Fatal().Msg("Failed to get associated state on pool return")
 	}
 
-	if as.GetTakeCount() > 10000 {
-		go func() {
-			state.Close()
-			las.Free(state)
+	// subscriptions only last as long as the handler that made them
+	as.CloseSubscriptions()
 
-			nuState, err := p.newState()
-			if err != nil {
-				log.Fatal().Err(err).Msg("Failed to allocate new state")
-			}
+	p.lock.Lock()
+	p.inUse--
+	p.drained.Broadcast()
+	if p.closed {
+		p.size--
+		p.lock.Unlock()
+		closeState(state)
+		return
+	}
 
-			p.lock.Lock()
-			p.stack = append(p.stack, nuState)
-			p.top++
-			p.lock.Unlock()
+	if as.GetTakeCount() > p.config.PoolRecycleAt {
+		p.lock.Unlock()
+
+		statesRecycled.Inc()
+		go func() {
+			closeState(state)
+			p.replace()
 		}()
 
 		return
 	}
 
+	p.put(state)
+	p.lock.Unlock()
+}
+
+// Discard a *lua.State taken from the pool instead of returning it
+// Used for state that may be corrupted, like after a Lua error
+func (p *Pool) Discard(state *lua.State) {
+	closeState(state)
+	statesDiscarded.Inc()
+
 	p.lock.Lock()
-	p.stack = append(p.stack, state)
-	p.top++
+	p.inUse--
+	p.drained.Broadcast()
+	if p.closed {
+		p.size--
+		p.lock.Unlock()
+		return
+	}
 	p.lock.Unlock()
+
+	go p.replace()
+}
+
+// replace a state that was closed while it counted towards the size of the pool
+func (p *Pool) replace() {
+	state, err := p.newState()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err != nil {
+		p.size--
+		log.Error().Err(err).Msg("Failed to allocate replacement state")
+		return
+	}
+
+	if p.closed {
+		p.size--
+		closeState(state)
+		return
+	}
+
+	p.put(state)
+}
+
+// grow the pool by up to count states in the background
+func (p *Pool) grow(count int) {
+	p.lock.Lock()
+	if p.config.PoolMaxSize > 0 && p.size+count > p.config.PoolMaxSize {
+		count = p.config.PoolMaxSize - p.size
+	}
+	if count <= 0 {
+		p.lock.Unlock()
+		return
+	}
+	p.size += count
+	p.lock.Unlock()
+
+	for i := 0; i < count; i++ {
+		go p.replace()
+	}
+}
+
+// maintain the size of the pool until it's closed
+// it pre-warms state when utilization is high and reaps state that has been idle for too long
+func (p *Pool) maintain() {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		p.lock.Lock()
+		// grow by a quarter of the pool so a spike is met with state that's already initialized
+		// an empty pool isn't under any load so it's left to grow on demand instead of flapping with the reaper
+		grow := 0
+		if p.size < p.config.PoolMinSize {
+			grow = p.config.PoolMinSize - p.size
+		} else if (p.size > 0 && float64(p.inUse) >= highUtilization*float64(p.size)) || len(p.waiters) > 0 {
+			grow = p.size/4 + 1
+		}
+
+		reaped := make([]*lua.State, 0)
+		if grow == 0 {
+			cutoff := time.Now().Add(-p.config.PoolIdleTimeout)
+			for i := 0; i < len(p.stack) && p.size > p.config.PoolMinSize; {
+				if p.stack[i].since.After(cutoff) {
+					i++
+					continue
+				}
+
+				reaped = append(reaped, p.stack[i].state)
+				p.stack[i] = p.stack[len(p.stack)-1]
+				p.stack = p.stack[:len(p.stack)-1]
+				p.size--
+			}
+		}
+		p.lock.Unlock()
+
+		if grow > 0 {
+			p.grow(grow)
+		}
+
+		for _, state := range reaped {
+			closeState(state)
+			statesReaped.Inc()
+		}
+		if len(reaped) > 0 {
+			log.Debug().Int("count", len(reaped)).Msg("Reaped idle lua state")
+		}
+	}
+}
+
+// NewDetached initializes a *lua.State with the pool's initializer that isn't part of the pool
+// It's for long lived work like websocket connections that would otherwise hold pooled state hostage
+// Detached state is capped separately from the pool and NewDetached gives up with ErrDetachedExhausted past the cap
+// The state must be closed with CloseDetached once it's no longer needed
+func (p *Pool) NewDetached() (*lua.State, error) {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil, ErrClosed
+	}
+
+	if p.detachedFull() {
+		p.lock.Unlock()
+		return nil, ErrDetachedExhausted
+	}
+	p.detached++
+	p.lock.Unlock()
+
+	state, err := p.newState()
+	if err != nil {
+		p.lock.Lock()
+		p.detached--
+		p.lock.Unlock()
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Detach a *lua.State taken from the pool so it's no longer part of the pool
+// It's for a request that turns into long lived work, like a streamed response, that has to keep running on the same state
+// The pool replaces the state in the background and Detach gives up with ErrDetachedExhausted past the cap
+// in which case the state is still taken from the pool
+// The state must be closed with CloseDetached once it's no longer needed
+func (p *Pool) Detach(state *lua.State) error {
+	p.lock.Lock()
+	if p.detachedFull() {
+		p.lock.Unlock()
+		return ErrDetachedExhausted
+	}
+	p.detached++
+	p.inUse--
+	p.drained.Broadcast()
+	if p.closed {
+		p.size--
+		p.lock.Unlock()
+		return nil
+	}
+	p.lock.Unlock()
+
+	go p.replace()
+
+	return nil
+}
+
+// CloseDetached closes a *lua.State created by NewDetached or detached with Detach and frees its associated state
+func (p *Pool) CloseDetached(state *lua.State) {
+	closeState(state)
+
+	p.lock.Lock()
+	p.detached--
+	p.drained.Broadcast()
+	p.lock.Unlock()
+}
+
+// DetachedAvailable reports if NewDetached would be under the cap right now
+// Useful to turn work away before committing to it, though NewDetached can still fail if others got there first
+func (p *Pool) DetachedAvailable() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return !p.closed && !p.detachedFull()
+}
+
+// the lock must be held
+func (p *Pool) detachedFull() bool {
+	return p.config.PoolMaxDetached > 0 && p.detached >= p.config.PoolMaxDetached
+}
+
+// Stats about how the pool's state is being used right now
+func (p *Pool) Stats() Stats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return Stats{
+		Size:     p.size,
+		InUse:    p.inUse,
+		Idle:     len(p.stack),
+		Waiting:  len(p.waiters),
+		Detached: p.detached,
+	}
+}
+
+// Close the pool once every taken *lua.State has been returned or discarded and every detached state has been closed
+// State returned after Close is called is closed instead of going back into the pool
+func (p *Pool) Close() {
+	p.lock.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.stop)
+		for _, waiter := range p.waiters {
+			close(waiter)
+		}
+		p.waiters = nil
+	}
+
+	for p.inUse > 0 || p.detached > 0 {
+		p.drained.Wait()
+	}
+	p.lock.Unlock()
+
+	p.Cleanup()
 }
 
 // Cleanup the pool and all of its state
 func (p *Pool) Cleanup() {
-	for _, state := range p.stack {
-		state.Close()
-		las.Free(state)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, idle := range p.stack {
+		closeState(idle.state)
 	}
+	p.size -= len(p.stack)
+	p.stack = p.stack[:0]
 }
@@ -0,0 +1,334 @@
+package pool_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/sosodev/heart/config"
+	"github.com/sosodev/heart/las"
+	"github.com/sosodev/heart/pool"
+)
+
+// initialize state with the standard library and associated state like the real initializer does
+func initialize(state *lua.State) error {
+	state.OpenLibs()
+	return las.Update(state, func(as *las.AssociatedState) error {
+		return nil
+	})
+}
+
+func newPool(t *testing.T, cfg *config.Config) *pool.Pool {
+	statePool, err := pool.New(cfg, initialize)
+	if err != nil {
+		t.Fatalf("failed to create the pool: %s", err)
+	}
+
+	return statePool
+}
+
+// wait for the condition to hold or fail the test after a few maintenance intervals
+func eventually(t *testing.T, message string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func take(t *testing.T, statePool *pool.Pool) *lua.State {
+	state, err := statePool.Take()
+	if err != nil {
+		t.Fatalf("failed to take state: %s", err)
+	}
+
+	return state
+}
+
+func TestCloseWaitsForDetached(t *testing.T) {
+	statePool := newPool(t, &config.Config{
+		InitialPoolSize: 1,
+		PoolMinSize:     1,
+		PoolMaxSize:     1,
+		PoolWaitTimeout: time.Second,
+		PoolIdleTimeout: time.Minute,
+		PoolRecycleAt:   10000,
+	})
+
+	state, err := statePool.NewDetached()
+	if err != nil {
+		t.Fatalf("failed to create detached state: %s", err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		statePool.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("the pool closed while detached state was still open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	statePool.CloseDetached(state)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("the pool didn't close once the detached state was closed")
+	}
+}
+
+func TestEmptyPoolStaysEmpty(t *testing.T) {
+	statePool := newPool(t, &config.Config{
+		PoolWaitTimeout: time.Second,
+		PoolIdleTimeout: time.Minute,
+		PoolRecycleAt:   10000,
+	})
+	defer statePool.Close()
+
+	// long enough for the maintenance loop to run
+	time.Sleep(1500 * time.Millisecond)
+
+	if size := statePool.Stats().Size; size != 0 {
+		t.Errorf("an idle pool with a min size of 0 shouldn't grow but has %d states", size)
+	}
+}
+
+func TestNewClosesStateOnFailure(t *testing.T) {
+	created := make([]*lua.State, 0)
+	failure := errors.New("syntax error")
+
+	_, err := pool.New(&config.Config{
+		InitialPoolSize: 3,
+		PoolWaitTimeout: time.Second,
+		PoolIdleTimeout: time.Minute,
+		PoolRecycleAt:   10000,
+	}, func(state *lua.State) error {
+		if len(created) == 2 {
+			return failure
+		}
+
+		created = append(created, state)
+		return initialize(state)
+	})
+	if err != failure {
+		t.Fatalf("expected the initializer's error but got %v", err)
+	}
+
+	for _, state := range created {
+		if _, ok := las.Get(state); ok {
+			t.Error("state created before the initializer failed wasn't closed")
+		}
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	statePool := newPool(t, &config.Config{
+		PoolMaxSize:     2,
+		PoolWaitTimeout: 50 * time.Millisecond,
+		PoolIdleTimeout: time.Minute,
+		PoolRecycleAt:   10000,
+	})
+	defer statePool.Close()
+
+	first := take(t, statePool)
+	second := take(t, statePool)
+
+	_, err := statePool.Take()
+	if err != pool.ErrExhausted {
+		t.Errorf("taking past the max size should fail with ErrExhausted but got %v", err)
+	}
+	if size := statePool.Stats().Size; size != 2 {
+		t.Errorf("the pool should stop at its max size of 2 but has %d states", size)
+	}
+
+	statePool.Return(first)
+	statePool.Return(second)
+}
+
+func TestReturnHandsStateToWaiter(t *testing.T) {
+	statePool := newPool(t, &config.Config{
+		InitialPoolSize: 1,
+		PoolMaxSize:     1,
+		PoolMaxWaiters:  1,
+		PoolWaitTimeout: 5 * time.Second,
+		PoolIdleTimeout: time.Minute,
+		PoolRecycleAt:   10000,
+	})
+	defer statePool.Close()
+
+	state := take(t, statePool)
+
+	taken := make(chan *lua.State)
+	go func() {
+		waited, err := statePool.Take()
+		if err != nil {
+			t.Errorf("the waiter failed to take state: %s", err)
+		}
+		taken <- waited
+	}()
+
+	eventually(t, "the take never started waiting", func() bool {
+		return statePool.Stats().Waiting == 1
+	})
+	statePool.Return(state)
+
+	waited := <-taken
+	if waited != state {
+		t.Error("the returned state should be handed to the waiter")
+	}
+	statePool.Return(waited)
+}
+
+func TestWaitTimeout(t *testing.T) {
+	statePool := newPool(t, &config.Config{
+		InitialPoolSize: 1,
+		PoolMaxSize:     1,
+		PoolMaxWaiters:  1,
+		PoolWaitTimeout: 100 * time.Millisecond,
+		PoolIdleTimeout: time.Minute,
+		PoolRecycleAt:   10000,
+	})
+	defer statePool.Close()
+
+	state := take(t, statePool)
+
+	start := time.Now()
+	_, err := statePool.Take()
+	if err != pool.ErrExhausted {
+		t.Errorf("the wait should time out with ErrExhausted but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("the take gave up after %s instead of waiting 100ms", elapsed)
+	}
+	if waiting := statePool.Stats().Waiting; waiting != 0 {
+		t.Errorf("the timed out take should leave the queue but %d are waiting", waiting)
+	}
+
+	statePool.Return(state)
+}
+
+func TestMaxWaiters(t *testing.T) {
+	statePool := newPool(t, &config.Config{
+		InitialPoolSize: 1,
+		PoolMaxSize:     1,
+		PoolMaxWaiters:  1,
+		PoolWaitTimeout: 5 * time.Second,
+		PoolIdleTimeout: time.Minute,
+		PoolRecycleAt:   10000,
+	})
+	defer statePool.Close()
+
+	state := take(t, statePool)
+
+	taken := make(chan *lua.State)
+	go func() {
+		waited, _ := statePool.Take()
+		taken <- waited
+	}()
+
+	eventually(t, "the take never started waiting", func() bool {
+		return statePool.Stats().Waiting == 1
+	})
+
+	// the queue is full so this take is turned away instead of waiting out the timeout
+	start := time.Now()
+	_, err := statePool.Take()
+	if err != pool.ErrExhausted {
+		t.Errorf("taking past the max waiters should fail with ErrExhausted but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the take past the max waiters waited for %s", elapsed)
+	}
+
+	statePool.Return(state)
+	statePool.Return(<-taken)
+}
+
+func TestReapIdle(t *testing.T) {
+	statePool := newPool(t, &config.Config{
+		InitialPoolSize: 3,
+		PoolMinSize:     1,
+		PoolMaxSize:     3,
+		PoolWaitTimeout: time.Second,
+		PoolIdleTimeout: 10 * time.Millisecond,
+		PoolRecycleAt:   10000,
+	})
+	defer statePool.Close()
+
+	eventually(t, "idle state wasn't reaped down to the min size", func() bool {
+		return statePool.Stats().Size == 1
+	})
+
+	// the min size is kept no matter how long it sits idle
+	time.Sleep(1500 * time.Millisecond)
+	if size := statePool.Stats().Size; size != 1 {
+		t.Errorf("the pool should stay at its min size of 1 but has %d states", size)
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	statePool := newPool(t, &config.Config{
+		InitialPoolSize: 4,
+		PoolMinSize:     4,
+		PoolMaxSize:     16,
+		PoolWaitTimeout: time.Second,
+		PoolIdleTimeout: time.Minute,
+		PoolRecycleAt:   10000,
+	})
+	defer statePool.Close()
+
+	// 3 of 4 states in use is high enough utilization to grow before anything has to wait
+	states := []*lua.State{take(t, statePool), take(t, statePool), take(t, statePool)}
+
+	eventually(t, "the pool didn't pre-warm state under high utilization", func() bool {
+		stats := statePool.Stats()
+		return stats.Size > 4 && stats.Idle > 1
+	})
+
+	for _, state := range states {
+		statePool.Return(state)
+	}
+}
+
+func TestRecycle(t *testing.T) {
+	statePool := newPool(t, &config.Config{
+		InitialPoolSize: 1,
+		PoolMinSize:     1,
+		PoolMaxSize:     1,
+		PoolMaxWaiters:  1,
+		PoolWaitTimeout: 5 * time.Second,
+		PoolIdleTimeout: time.Minute,
+		PoolRecycleAt:   2,
+	})
+	defer statePool.Close()
+
+	first := take(t, statePool)
+	for i := 0; i < 2; i++ {
+		statePool.Return(first)
+		if take(t, statePool) != first {
+			t.Fatal("the only state in the pool should be reused until it's recycled")
+		}
+	}
+
+	// the third take is past the recycle count so the state is replaced when it's returned
+	statePool.Return(first)
+	replacement := take(t, statePool)
+	if replacement == first {
+		t.Error("the state should be recycled once it's been taken more than PoolRecycleAt times")
+	}
+	if _, ok := las.Get(first); ok {
+		t.Error("the recycled state should be closed")
+	}
+	if size := statePool.Stats().Size; size != 1 {
+		t.Errorf("recycling shouldn't change the size of the pool but it has %d states", size)
+	}
+
+	statePool.Return(replacement)
+}
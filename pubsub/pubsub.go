@@ -0,0 +1,169 @@
+// Package pubsub broadcasts messages to every subscriber of a topic
+// the broker is shared by every *lua.State so handlers running on different state can talk to each other
+package pubsub
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sosodev/heart/metrics"
+)
+
+// DefaultBuffer is how many messages a subscriber of the Default broker can fall behind by before messages are dropped
+const DefaultBuffer = 64
+
+var (
+	// ErrClosed is returned by Receive once the subscription or its broker has been closed
+	ErrClosed = errors.New("the subscription has been closed")
+	// ErrTimeout is returned by Receive when no message was published in time
+	ErrTimeout = errors.New("timed out waiting for a message")
+
+	// Default broker used by the Lua module
+	Default = NewBroker(DefaultBuffer)
+
+	messagesDropped = metrics.NewCounter("heart_pubsub_messages_dropped_total", "Messages dropped because a subscriber fell too far behind")
+)
+
+// Broker fans out the messages published to a topic to the topic's subscribers
+type Broker struct {
+	lock   sync.Mutex
+	topics map[string]map[*Subscription]struct{}
+	buffer int
+	closed bool
+}
+
+// Subscription to a single topic
+type Subscription struct {
+	broker   *Broker
+	topic    string
+	messages chan string
+}
+
+// NewBroker with room for buffer messages per subscriber
+func NewBroker(buffer int) *Broker {
+	return &Broker{
+		topics: make(map[string]map[*Subscription]struct{}),
+		buffer: buffer,
+	}
+}
+
+// Publish the message to every subscriber of the topic and return how many got it
+// publishing never blocks so subscribers with a full buffer miss the message
+func (b *Broker) Publish(topic, message string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delivered := 0
+	for subscription := range b.topics[topic] {
+		select {
+		case subscription.messages <- message:
+			delivered++
+		default:
+			messagesDropped.Inc()
+		}
+	}
+
+	return delivered
+}
+
+// Subscribe to the messages published to the topic from now on
+// the subscription must be closed once it's no longer needed
+func (b *Broker) Subscribe(topic string) *Subscription {
+	subscription := &Subscription{
+		broker:   b,
+		topic:    topic,
+		messages: make(chan string, b.buffer),
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		close(subscription.messages)
+		return subscription
+	}
+
+	if b.topics[topic] == nil {
+		b.topics[topic] = make(map[*Subscription]struct{})
+	}
+	b.topics[topic][subscription] = struct{}{}
+
+	return subscription
+}
+
+// Subscribers of the topic right now
+func (b *Broker) Subscribers(topic string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return len(b.topics[topic])
+}
+
+// Close the broker and every subscription to it
+// publishing to a closed broker does nothing and subscribing to it gets a subscription that's already closed
+func (b *Broker) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	for _, subscriptions := range b.topics {
+		for subscription := range subscriptions {
+			close(subscription.messages)
+		}
+	}
+	b.topics = make(map[string]map[*Subscription]struct{})
+}
+
+// Messages published to the topic which is closed along with the subscription
+func (s *Subscription) Messages() <-chan string {
+	return s.messages
+}
+
+// Receive the next message waiting up to the timeout or forever when it's 0
+func (s *Subscription) Receive(timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		message, ok := <-s.messages
+		if !ok {
+			return "", ErrClosed
+		}
+
+		return message, nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case message, ok := <-s.messages:
+		if !ok {
+			return "", ErrClosed
+		}
+
+		return message, nil
+	case <-timer.C:
+		return "", ErrTimeout
+	}
+}
+
+// Close the subscription, it's safe to close more than once
+func (s *Subscription) Close() {
+	b := s.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	subscriptions := b.topics[s.topic]
+	if _, ok := subscriptions[s]; !ok {
+		return
+	}
+
+	delete(subscriptions, s)
+	if len(subscriptions) == 0 {
+		delete(b.topics, s.topic)
+	}
+	close(s.messages)
+}
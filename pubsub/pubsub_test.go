@@ -0,0 +1,132 @@
+package pubsub_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sosodev/heart/pubsub"
+)
+
+func TestPublishToSeveralSubscribers(t *testing.T) {
+	broker := pubsub.NewBroker(16)
+	defer broker.Close()
+
+	const subscribers = 8
+	const messages = 10
+
+	subscriptions := make([]*pubsub.Subscription, subscribers)
+	for i := range subscriptions {
+		subscriptions[i] = broker.Subscribe("news")
+	}
+	other := broker.Subscribe("weather")
+
+	if count := broker.Subscribers("news"); count != subscribers {
+		t.Fatalf("expected %d subscribers but got %d", subscribers, count)
+	}
+
+	received := make([][]string, subscribers)
+	var wg sync.WaitGroup
+	for i, subscription := range subscriptions {
+		wg.Add(1)
+		go func(i int, subscription *pubsub.Subscription) {
+			defer wg.Done()
+			for len(received[i]) < messages {
+				message, err := subscription.Receive(time.Second)
+				if err != nil {
+					t.Errorf("subscriber %d failed to receive: %s", i, err)
+					return
+				}
+				received[i] = append(received[i], message)
+			}
+		}(i, subscription)
+	}
+
+	for i := 0; i < messages; i++ {
+		delivered := broker.Publish("news", fmt.Sprintf("story %d", i))
+		if delivered != subscribers {
+			t.Errorf("expected story %d to be delivered to %d subscribers but it was delivered to %d", i, subscribers, delivered)
+		}
+	}
+	wg.Wait()
+
+	for i, messages := range received {
+		for j, message := range messages {
+			if expected := fmt.Sprintf("story %d", j); message != expected {
+				t.Errorf("subscriber %d expected %q but got %q", i, expected, message)
+			}
+		}
+	}
+
+	_, err := other.Receive(10 * time.Millisecond)
+	if err != pubsub.ErrTimeout {
+		t.Errorf("subscriber of another topic should time out but got %v", err)
+	}
+}
+
+func TestSlowSubscriberMissesMessages(t *testing.T) {
+	broker := pubsub.NewBroker(2)
+	defer broker.Close()
+
+	slow := broker.Subscribe("ticks")
+	for i := 0; i < 5; i++ {
+		broker.Publish("ticks", fmt.Sprint(i))
+	}
+
+	for _, expected := range []string{"0", "1"} {
+		message, err := slow.Receive(time.Second)
+		if err != nil || message != expected {
+			t.Errorf("expected %q but got %q and %v", expected, message, err)
+		}
+	}
+
+	_, err := slow.Receive(10 * time.Millisecond)
+	if err != pubsub.ErrTimeout {
+		t.Errorf("messages past the buffer should have been dropped but got %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	broker := pubsub.NewBroker(1)
+
+	subscription := broker.Subscribe("chat")
+	subscription.Close()
+	subscription.Close()
+
+	if count := broker.Subscribers("chat"); count != 0 {
+		t.Errorf("closed subscription should be removed but there are %d subscribers", count)
+	}
+
+	_, err := subscription.Receive(0)
+	if err != pubsub.ErrClosed {
+		t.Errorf("expected ErrClosed from a closed subscription but got %v", err)
+	}
+
+	waiting := broker.Subscribe("chat")
+	done := make(chan error)
+	go func() {
+		_, err := waiting.Receive(0)
+		done <- err
+	}()
+
+	broker.Close()
+	select {
+	case err := <-done:
+		if err != pubsub.ErrClosed {
+			t.Errorf("expected ErrClosed once the broker closed but got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("closing the broker didn't end a waiting Receive")
+	}
+	waiting.Close()
+
+	if delivered := broker.Publish("chat", "anyone?"); delivered != 0 {
+		t.Errorf("publishing to a closed broker shouldn't deliver but it did to %d", delivered)
+	}
+
+	_, err = broker.Subscribe("chat").Receive(0)
+	if err != pubsub.ErrClosed {
+		t.Errorf("subscribing to a closed broker should be closed but got %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+// Package reload rebuilds the Lua app when its source changes
+// it's meant for development where restarting the server after every edit gets old fast
+package reload
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/sosodev/heart/build"
+	"github.com/sosodev/heart/config"
+	"github.com/sosodev/heart/pool"
+	"github.com/valyala/fasthttp"
+)
+
+// Reloader holds the current generation of the Lua app and swaps in a new one when the source changes
+type Reloader struct {
+	config      *config.Config
+	newApp      func() *fiber.App
+	initializer func(*lua.State) error
+	current     *generation
+	swap        sync.RWMutex
+	lock        sync.Mutex
+}
+
+// generation is a single build of the Lua app
+// the pool and the routes built from it are always swapped together
+// requests counts the requests it's handling so it isn't closed out from under them
+type generation struct {
+	pool         *pool.Pool
+	handler      fasthttp.RequestHandler
+	stopWatchers func()
+	files        []string
+	requests     sync.WaitGroup
+}
+
+// New gets you a *Reloader with the initial generation of the Lua app built
+// newApp should return a fresh *fiber.App for the routes of each generation
+// and initializer is the same initializer given to pool.New
+func New(config *config.Config, newApp func() *fiber.App, initializer func(*lua.State) error) (*Reloader, error) {
+	reloader := &Reloader{
+		config:      config,
+		newApp:      newApp,
+		initializer: initializer,
+	}
+
+	nuGeneration, err := reloader.build()
+	if err != nil {
+		return nil, err
+	}
+	reloader.current = nuGeneration
+
+	return reloader, nil
+}
+
+// Handler is fiber middleware that hands every request to the current generation
+// the generation is held until the request is done even if it's swapped out in the meantime
+func (r *Reloader) Handler(ctx *fiber.Ctx) error {
+	current := r.acquire()
+	defer current.requests.Done()
+
+	current.handler(ctx.Context())
+	return nil
+}
+
+// Pool of the current generation
+func (r *Reloader) Pool() *pool.Pool {
+	return r.load().pool
+}
+
+// Reload the Lua app and swap it in
+// requests that are already running finish on the old generation before its state is closed
+func (r *Reloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	nuGeneration, err := r.build()
+	if err != nil {
+		return err
+	}
+
+	r.swap.Lock()
+	oldGeneration := r.current
+	r.current = nuGeneration
+	r.swap.Unlock()
+
+	go oldGeneration.close()
+
+	return nil
+}
+
+// Close the current generation once its requests are done
+func (r *Reloader) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.load().close()
+}
+
+// close the generation once the requests it's handling are done
+// it must have been swapped out, or the reloader closed, so no more requests acquire it
+func (g *generation) close() {
+	g.requests.Wait()
+	g.stopWatchers()
+	g.pool.Close()
+}
+
+// Watch the entry file and every Lua module it requires and reload when any of them change
+// It blocks forever so it should be run in its own goroutine
+func (r *Reloader) Watch(interval time.Duration) {
+	modified := modTimes(r.load().files)
+
+	for range time.Tick(interval) {
+		current := modTimes(r.load().files)
+		if !changed(modified, current) {
+			continue
+		}
+
+		log.Info().Msg("Lua source changed, reloading")
+		err := r.Reload()
+		if err != nil {
+			// the old generation keeps serving so a typo doesn't take the server down
+			log.Error().Err(err).Msg("Failed to reload")
+			modified = current
+			continue
+		}
+
+		modified = modTimes(r.load().files)
+		log.Info().Msg("Reloaded 💜")
+	}
+}
+
+func (r *Reloader) load() *generation {
+	r.swap.RLock()
+	defer r.swap.RUnlock()
+
+	return r.current
+}
+
+// acquire the current generation for a request which must call requests.Done on it when it's over
+// it's counted while the swap lock is held so the count can't go up once the generation has been swapped out
+func (r *Reloader) acquire() *generation {
+	r.swap.RLock()
+	defer r.swap.RUnlock()
+
+	r.current.requests.Add(1)
+	return r.current
+}
+
+// build a new generation from scratch
+func (r *Reloader) build() (*generation, error) {
+	statePool, err := pool.New(r.config, r.initializer)
+	if err != nil {
+		return nil, err
+	}
+
+	app := r.newApp()
+	build.Routes(app, statePool)
+	stopWatchers := build.Watchers(statePool)
+
+	state, err := statePool.Take()
+	if err != nil {
+		stopWatchers()
+		statePool.Close()
+		return nil, err
+	}
+	files := append([]string{r.config.Path}, requiredFiles(state)...)
+	statePool.Return(state)
+
+	return &generation{
+		pool:         statePool,
+		handler:      app.Handler(),
+		stopWatchers: stopWatchers,
+		files:        files,
+	}, nil
+}
+
+// find the files behind every module that's been required in the state
+// modules are resolved against package.path the same way require does
+// preloaded modules like heart.v1 don't have files so they're skipped
+func requiredFiles(state *lua.State) []string {
+	state.GetGlobal("package")
+	pkg := state.GetTop()
+	defer state.Pop(1)
+
+	state.GetField(pkg, "path")
+	templates := strings.Split(state.ToString(-1), ";")
+	state.Pop(1)
+
+	names := make([]string, 0)
+	state.GetField(pkg, "loaded")
+	state.PushNil()
+	for state.Next(-2) != 0 {
+		if state.Type(-2) == lua.LUA_TSTRING {
+			names = append(names, state.ToString(-2))
+		}
+		state.Pop(1)
+	}
+	state.Pop(1)
+
+	files := make([]string, 0, len(names))
+	for _, name := range names {
+		modulePath := strings.Replace(name, ".", "/", -1)
+		for _, template := range templates {
+			file := strings.Replace(template, "?", modulePath, -1)
+			if info, err := os.Stat(file); err == nil && !info.IsDir() {
+				files = append(files, file)
+				break
+			}
+		}
+	}
+
+	return files
+}
+
+// get the modification times of the files
+// files that can't be read are left out so deleting one counts as a change
+func modTimes(files []string) map[string]time.Time {
+	times := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		times[file] = info.ModTime()
+	}
+
+	return times
+}
+
+func changed(before, after map[string]time.Time) bool {
+	if len(before) != len(after) {
+		return true
+	}
+
+	for file, modified := range after {
+		if !before[file].Equal(modified) {
+			return true
+		}
+	}
+
+	return false
+}
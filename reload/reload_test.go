@@ -0,0 +1,98 @@
+package reload_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aarzilli/golua/lua"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sosodev/heart/config"
+	"github.com/sosodev/heart/modules"
+	"github.com/sosodev/heart/reload"
+)
+
+func TestReloadDuringRequests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.lua")
+	err := ioutil.WriteFile(path, []byte(`
+		local app = require('heart.v1')
+
+		app.get('/', function(ctx)
+			return 'ok'
+		end)
+	`), 0644)
+	if err != nil {
+		t.Fatalf("failed to write the app: %s", err)
+	}
+
+	cfg := &config.Config{
+		Path:            path,
+		InitialPoolSize: 1,
+		PoolMinSize:     1,
+		PoolMaxSize:     4,
+		PoolMaxWaiters:  64,
+		PoolWaitTimeout: 5 * time.Second,
+		PoolIdleTimeout: time.Minute,
+		PoolRecycleAt:   10000,
+	}
+
+	reloader, err := reload.New(cfg, func() *fiber.App {
+		return fiber.New()
+	}, func(state *lua.State) error {
+		for _, load := range []func(*lua.State) error{modules.LoadJSON, modules.LoadContext, modules.LoadHeart} {
+			err := load(state)
+			if err != nil {
+				return err
+			}
+		}
+
+		return state.DoFile(path)
+	})
+	if err != nil {
+		t.Fatalf("failed to create the reloader: %s", err)
+	}
+
+	app := fiber.New()
+	app.Use(reloader.Handler)
+
+	// requests that picked up a generation right before it was swapped out still finish on it
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				resp, err := app.Test(httptest.NewRequest("GET", "/", nil), 10000)
+				if err != nil {
+					t.Errorf("request failed: %s", err)
+					return
+				}
+				if resp.StatusCode != fiber.StatusOK {
+					t.Errorf("request failed during a reload with %d", resp.StatusCode)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		err = reloader.Reload()
+		if err != nil {
+			t.Fatalf("failed to reload: %s", err)
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+	reloader.Close()
+}
@@ -0,0 +1,130 @@
+// Package secure protects values that are handed to clients so they can be trusted when they come back
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+)
+
+// Key derives a key for the purpose from the secret so a single secret can key everything without reusing keys
+func Key(secret, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// Token of n random bytes encoded so it's safe to use in URLs and cookies
+func Token(n int) (string, error) {
+	token := make([]byte, n)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// Signer signs values with HMAC-SHA256 so they can't be changed without the key
+type Signer struct {
+	key []byte
+}
+
+// NewSigner that signs with the key
+func NewSigner(key []byte) *Signer {
+	return &Signer{key: key}
+}
+
+// Sign the value, the signed value is the value followed by a dot and its signature
+// the signature covers the name, like the name of the cookie the value is kept in,
+// so a value signed for one name doesn't verify under another
+func (s *Signer) Sign(name string, value string) string {
+	return value + "." + base64.RawURLEncoding.EncodeToString(s.mac(name, value))
+}
+
+// Verify the value signed for the name and return the value or a false second return value if it was tampered with
+func (s *Signer) Verify(name string, signed string) (string, bool) {
+	separator := strings.LastIndexByte(signed, '.')
+	if separator < 0 {
+		return "", false
+	}
+
+	value := signed[:separator]
+	signature, err := base64.RawURLEncoding.DecodeString(signed[separator+1:])
+	if err != nil {
+		return "", false
+	}
+
+	if !hmac.Equal(signature, s.mac(name, value)) {
+		return "", false
+	}
+
+	return value, true
+}
+
+// the name is length prefixed so the boundary between it and the value can't be shifted
+func (s *Signer) mac(name string, value string) []byte {
+	length := make([]byte, 8)
+	binary.BigEndian.PutUint64(length, uint64(len(name)))
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(length)
+	mac.Write([]byte(name))
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// Cipher encrypts values with AES-GCM so they can't be read or changed without the key
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher that encrypts with the key which has to be 16, 24 or 32 bytes long to pick AES-128, AES-192 or AES-256
+func NewCipher(key []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt the value with a random nonce that's kept at the front of the encrypted value
+// the name, like the name of the cookie the value is kept in, is authenticated along with it
+// so a value encrypted for one name doesn't decrypt under another
+func (c *Cipher) Encrypt(name string, value string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := c.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt the value encrypted for the name and return the value or a false second return value if it was tampered with
+func (c *Cipher) Decrypt(name string, encrypted string) (string, bool) {
+	sealed, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", false
+	}
+
+	nonce := sealed[:c.aead.NonceSize()]
+	value, err := c.aead.Open(nil, nonce, sealed[c.aead.NonceSize():], []byte(name))
+	if err != nil {
+		return "", false
+	}
+
+	return string(value), true
+}
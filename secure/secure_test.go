@@ -0,0 +1,163 @@
+package secure_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sosodev/heart/secure"
+)
+
+func TestKey(t *testing.T) {
+	sessions := secure.Key("secret", "session")
+	if !bytes.Equal(sessions, secure.Key("secret", "session")) {
+		t.Error("the same secret and purpose should derive the same key")
+	}
+
+	if bytes.Equal(sessions, secure.Key("secret", "cookie")) {
+		t.Error("different purposes should derive different keys")
+	}
+
+	if bytes.Equal(sessions, secure.Key("other secret", "session")) {
+		t.Error("different secrets should derive different keys")
+	}
+}
+
+func TestToken(t *testing.T) {
+	first, err := secure.Token(32)
+	if err != nil {
+		t.Fatalf("failed to generate token: %s", err)
+	}
+
+	second, err := secure.Token(32)
+	if err != nil {
+		t.Fatalf("failed to generate token: %s", err)
+	}
+
+	if first == second {
+		t.Error("tokens should be random")
+	}
+
+	if len(first) != 43 {
+		t.Errorf("32 random bytes should encode to 43 characters but got %d", len(first))
+	}
+}
+
+func TestSigner(t *testing.T) {
+	signer := secure.NewSigner(secure.Key("secret", "test"))
+
+	for _, value := range []string{"", "session-id", "has.dots.in.it", "ünïcode"} {
+		signed := signer.Sign("cookie", value)
+		if !strings.HasPrefix(signed, value+".") {
+			t.Errorf("signed value %q should start with the value %q", signed, value)
+		}
+
+		verified, ok := signer.Verify("cookie", signed)
+		if !ok || verified != value {
+			t.Errorf("expected %q to verify as %q but got %q and %v", signed, value, verified, ok)
+		}
+	}
+
+	signed := signer.Sign("cookie", "user-1")
+	tampered := []string{
+		"user-2" + signed[len("user-1"):],
+		signed[:len(signed)-1],
+		signed + "A",
+		"user-1",
+		"user-1.",
+		"user-1.not base64!",
+		secure.NewSigner(secure.Key("other secret", "test")).Sign("cookie", "user-1"),
+	}
+
+	for _, value := range tampered {
+		verified, ok := signer.Verify("cookie", value)
+		if ok {
+			t.Errorf("tampered value %q verified as %q", value, verified)
+		}
+	}
+}
+
+func TestSignerNames(t *testing.T) {
+	signer := secure.NewSigner(secure.Key("secret", "test"))
+
+	signed := signer.Sign("role", "admin")
+	if verified, ok := signer.Verify("other", signed); ok {
+		t.Errorf("value signed for role verified under other as %q", verified)
+	}
+
+	// shifting bytes between the name and the value changes the signature
+	first := signer.Sign("ab", "c")
+	second := signer.Sign("a", "bc")
+	if first[len("c."):] == second[len("bc."):] {
+		t.Error("the boundary between the name and the value should be part of the signature")
+	}
+}
+
+func TestCipher(t *testing.T) {
+	cipher, err := secure.NewCipher(secure.Key("secret", "test"))
+	if err != nil {
+		t.Fatalf("failed to create cipher: %s", err)
+	}
+
+	for _, value := range []string{"", "user-1", `{"role":"admin"}`, "ünïcode"} {
+		encrypted, err := cipher.Encrypt("cookie", value)
+		if err != nil {
+			t.Fatalf("failed to encrypt %q: %s", value, err)
+		}
+
+		if value != "" && strings.Contains(encrypted, value) {
+			t.Errorf("encrypted value %q shouldn't contain %q", encrypted, value)
+		}
+
+		decrypted, ok := cipher.Decrypt("cookie", encrypted)
+		if !ok || decrypted != value {
+			t.Errorf("expected %q to decrypt as %q but got %q and %v", encrypted, value, decrypted, ok)
+		}
+	}
+
+	first, _ := cipher.Encrypt("cookie", "same")
+	second, _ := cipher.Encrypt("cookie", "same")
+	if first == second {
+		t.Error("encrypting the same value twice should use different nonces")
+	}
+
+	other, err := secure.NewCipher(secure.Key("other secret", "test"))
+	if err != nil {
+		t.Fatalf("failed to create cipher: %s", err)
+	}
+	fromOther, _ := other.Encrypt("cookie", "user-1")
+
+	encrypted, _ := cipher.Encrypt("cookie", "user-1")
+	flipped := []byte(encrypted)
+	if flipped[len(flipped)/2] == 'A' {
+		flipped[len(flipped)/2] = 'B'
+	} else {
+		flipped[len(flipped)/2] = 'A'
+	}
+
+	tampered := []string{
+		string(flipped),
+		encrypted[:len(encrypted)-2],
+		"",
+		"short",
+		"not base64!",
+		fromOther,
+	}
+
+	for _, value := range tampered {
+		decrypted, ok := cipher.Decrypt("cookie", value)
+		if ok {
+			t.Errorf("tampered value %q decrypted as %q", value, decrypted)
+		}
+	}
+
+	// a value can't be replayed under another name
+	if decrypted, ok := cipher.Decrypt("other", encrypted); ok {
+		t.Errorf("value encrypted for cookie decrypted under other as %q", decrypted)
+	}
+
+	_, err = secure.NewCipher([]byte("too short"))
+	if err == nil {
+		t.Error("a key that isn't a valid AES key size should fail")
+	}
+}